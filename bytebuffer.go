@@ -2,113 +2,214 @@ package tags
 
 import (
   "encoding/binary"
-  "fmt"
-  "os"
+  "errors"
+  "io"
 )
 
+// When a bytebuffer is backed by a reader, this is the most it reads at one time
+// (unless a single read asks for more).
+const bbwindow = 64 * 1024
+
+// A bytebuffer is either a slice of bytes, or a window onto part of an
+// io.ReaderAt.  In the second case, b holds the part of the reader that
+// starts at off, and is refilled as the buffer is read.
 type bytebuffer struct {
   b [] byte
   n int
+  r io.ReaderAt
+  start int64 // offset in r of the start of the buffer
+  off int64   // offset in r of b[0]
+  end int64   // offset in r of the end of the buffer
 }
 
-func bytebufferfromfile(path string) *bytebuffer {
+func bytebufferfromslice(buffer []byte) *bytebuffer {
   bb := new(bytebuffer)
-  bb.b = readFile(path)
+  bb.b = buffer
+  bb.end = int64(len(buffer))
   return bb
 }
 
-func bbFromFilePrefix(path string, size int) *bytebuffer {
+func bytebufferfromreader(r io.ReaderAt, size int64) *bytebuffer {
   bb := new(bytebuffer)
-  bb.b = make([]byte, size)
-  f, err := os.Open(path)
-  if err != nil {
-	  fmt.Printf("Unable to open %s for reading, error is %s\n", path, err.Error())
-	  os.Exit(1)
+  bb.r = r
+  bb.end = size
+  return bb
+}
+
+func bytebufferfromparent(parent *bytebuffer, size uint32) *bytebuffer {
+  return bytebufferfromparent64(parent, int64(size))
+}
+
+func bytebufferfromparent64(parent *bytebuffer, size int64) *bytebuffer {
+  if size > parent.remaining64() {
+    failf(ErrTruncated, "block of %d bytes runs past end of byte buffer", size)
+  }
+  bb := new(bytebuffer)
+  bb.r = parent.r
+  bb.start = parent.pos()
+  bb.off = bb.start
+  bb.end = bb.start + size
+  // Share whatever part of the parent's window falls inside the block.
+  if avail := int64(len(parent.b) - parent.n); avail >= size {
+    bb.b = parent.b[parent.n:parent.n+int(size)]
+  } else if parent.r != nil {
+    bb.b = parent.b[parent.n:]
+  }
+  parent.skip64(size)
+  return bb
+}
+
+// Returns the offset of the next byte to be read.
+func (bb *bytebuffer) pos() int64 {
+  return bb.off + int64(bb.n)
+}
+
+// Makes sure the next size bytes are in b, reading them from the
+// reader if necessary.
+func (bb *bytebuffer) fill(size int, what string) {
+  if bb.n + size <= len(bb.b) {
+    return
   }
-  n, err := f.Read(bb.b)
-  if err != nil {
-	  fmt.Printf("Unable to read %s, error is %s\n", path, err.Error())
-	  os.Exit(1)
+  p := bb.pos()
+  if bb.r == nil || p + int64(size) > bb.end {
+    failf(ErrTruncated, "attempt to %s past end of byte buffer", what)
   }
+  length := int64(size)
+  if length < bbwindow {
+    length = bbwindow
+  }
+  if length > bb.end - p {
+    length = bb.end - p
+  }
+  // Always use a new slice, since callers may still hold slices of the old one.
+  b := make([]byte, length)
+  n, err := bb.r.ReadAt(b, p)
   if n < size {
-	  fmt.Printf("File %s is %d bytes, wanted %d\n", path, n, size)
+    if err == nil || errors.Is(err, io.EOF) {
+      failf(ErrTruncated, "attempt to %s past end of file", what)
+    }
+    fail(err)
   }
-  return bb
+  bb.b = b[:n]
+  bb.off = p
+  bb.n = 0
 }
 
-func bytebufferfromslice(buffer []byte) *bytebuffer {
-  bb := new(bytebuffer)
-  bb.b = buffer
-  return bb
+// Reads the whole of a reader-backed buffer into memory, so later reads
+// (and rewinds) don't go back to the reader.
+func (bb *bytebuffer) load() {
+  if bb.r == nil {
+    return
+  }
+  bb.rewind()
+  bb.fill(int(bb.end - bb.start), "load")
+  bb.r = nil
 }
 
-func bytebufferfromparent(parent *bytebuffer, size uint32) *bytebuffer {
-  bb := new(bytebuffer)
-  bb.b = parent.b[parent.n:parent.n+int(size)]
-  parent.skip(size)
-  return bb
+// Returns the last size bytes of the buffer (or fewer, if the buffer is
+// shorter), without changing the position.
+func (bb *bytebuffer) tail(size int) []byte {
+  if int64(size) > bb.end - bb.start {
+    size = int(bb.end - bb.start)
+  }
+  if bb.r == nil || bb.off + int64(len(bb.b)) == bb.end && int64(len(bb.b)) >= int64(size) {
+    return bb.b[len(bb.b)-size:]
+  }
+  b := make([]byte, size)
+  n, err := bb.r.ReadAt(b, bb.end - int64(size))
+  if n < size {
+    if err == nil || errors.Is(err, io.EOF) {
+      failf(ErrTruncated, "attempt to read tail past end of file")
+    }
+    fail(err)
+  }
+  return b
 }
 
 func (bb *bytebuffer) peek() byte {
+  bb.fill(1, "peek")
   return bb.b[bb.n]
 }
 
+// Returns the next size bytes without consuming them.
+func (bb *bytebuffer) peekn(size int) []byte {
+  bb.fill(size, "peek")
+  return bb.b[bb.n:bb.n+size]
+}
+
 func (bb *bytebuffer) remaining() int {
-  return len(bb.b) - bb.n
+  return int(bb.remaining64())
+}
+
+func (bb *bytebuffer) remaining64() int64 {
+  return bb.end - bb.pos()
 }
 
 func (bb *bytebuffer) rewind() {
+  if bb.r != nil && bb.off != bb.start {
+    bb.b = nil
+    bb.off = bb.start
+  }
   bb.n = 0
 }
 
 func (bb *bytebuffer) readByte() uint32 {
-  if (bb.n + 1) > len(bb.b) {
-    panic("Attempt to read byte past end of byte buffer")
-  }
+  bb.fill(1, "read byte")
   u := uint32(bb.b[bb.n])
   bb.n++
   return u
 }
 
 func (bb *bytebuffer) read32BE() uint32 {
-  if (bb.n + 4) > len(bb.b) {
-    panic("Attempt to read 32 BE past end of byte buffer")
-  }
+  bb.fill(4, "read 32 BE")
   u := binary.BigEndian.Uint32(bb.b[bb.n:bb.n+4])
   bb.n += 4
   return u
 }
 
+func (bb *bytebuffer) read64BE() uint64 {
+  bb.fill(8, "read 64 BE")
+  u := binary.BigEndian.Uint64(bb.b[bb.n:bb.n+8])
+  bb.n += 8
+  return u
+}
+
 func (bb *bytebuffer) read16BE() uint16 {
-  if (bb.n + 2) > len(bb.b) {
-    panic("Attempt to read 16 BE past end of byte buffer")
-  }
+  bb.fill(2, "read 16 BE")
   u := binary.BigEndian.Uint16(bb.b[bb.n:bb.n+2])
   bb.n += 2
   return u
 }
 
 func (bb *bytebuffer) read32LE() uint32 {
-  if (bb.n + 4) > len(bb.b) {
-    panic("Attempt to read 32 LE past end of byte buffer")
-  }
+  bb.fill(4, "read 32 LE")
   u := binary.LittleEndian.Uint32(bb.b[bb.n:bb.n+4])
   bb.n += 4
   return u
 }
 
 func (bb *bytebuffer) read(size uint32) []byte {
-  if (int(size) + bb.n) > len(bb.b) {
-    panic("Attempt to read past end of byte buffer")
-  }
+  bb.fill(int(size), "read")
   b := bb.b[bb.n:bb.n+int(size)]
   bb.n += int(size)
   return b
 }
 
 func (bb *bytebuffer) skip(skip uint32) {
-  if (int(skip) + bb.n) > len(bb.b) {
-    panic("Attempt to skip past end of byte buffer")
+  bb.skip64(int64(skip))
+}
+
+// Skipping past the window of a reader-backed buffer doesn't read
+// anything; the next read starts a new window.
+func (bb *bytebuffer) skip64(skip int64) {
+  if skip > bb.remaining64() {
+    failf(ErrTruncated, "attempt to skip past end of byte buffer")
+  }
+  if int64(bb.n) + skip <= int64(len(bb.b)) {
+    bb.n += int(skip)
+    return
   }
-  bb.n += int(skip)
+  bb.off = bb.pos() + skip
+  bb.b = nil
+  bb.n = 0
 }
@@ -13,12 +13,33 @@ const BasePathKey = "basePath"
 const TitleKey = "title"
 const ArtistKey = "artist"
 const AlbumKey = "album"
+const AlbumArtistKey = "albumArtist"
+const ComposerKey = "composer"
+const GenreKey = "genre"
+const GroupingKey = "grouping"
+const BpmKey = "bpm"
+const CompilationKey = "compilation" // "true" or "false"
+const GaplessKey = "gapless" // "true" or "false"
+const CopyrightKey = "copyright"
+const IsrcKey = "isrc"
+const DescriptionKey = "description"
+const LongDescriptionKey = "longDescription"
+const RatingKey = "rating" // iTunes advisory: 0 none, 1 or 4 explicit, 2 clean
 const TrackNumberKey = "trackNumber"
 const DiscNumberKey = "discNumber"
+const TrackTotalKey = "trackTotal"
+const DiscTotalKey = "discTotal"
 const ArtistSortKey = "artistSort"
 const AlbumSortKey = "albumSort"
-const DurationKey = "duration"
+const TitleSortKey = "titleSort"
+const AlbumArtistSortKey = "albumArtistSort"
+const ComposerSortKey = "composerSort"
+const DurationKey = "duration" // [h:]mm:ss
+const DurationMillisKey = "durationMillis"
+const BitrateKey = "bitrate" // average, in kbit/s
+const DateKey = "date" // as written by the tagger, e.g. "2004" or "2004-05-17"
 const MimeKey = "mime"
+const CodecKey = "codec" // such as "mp3", "flac", "aac" or "alac"
 const ExtensionKey = "extension"
 const EncodedExtensionKey = "encodedExtension"
 const IsEncodedKey = "isEncoded"
@@ -26,6 +47,36 @@ const FlagsKey = "flags"
 const Md5Key = "md5"
 const SizeAndTimeKey = "sizeAndTime"
 const EncodedSourceKey = "encodedSource" // size and time of source of encoding
+const FrameCountKey = "frameCount" // number of MPEG audio frames
+const StreamBytesKey = "streamBytes" // size of the MPEG audio frames, in bytes
+const BitrateModeKey = "bitrateMode" // "vbr" or "cbr"
+const EncoderKey = "encoder"
+const EncoderDelayKey = "encoderDelay" // samples added at the start by the encoder
+const EncoderPaddingKey = "encoderPadding" // samples added at the end by the encoder
+const LowpassKey = "lowpass" // in Hz
+const ReplayGainTrackGainKey = "replayGainTrackGain" // e.g. "-6.20 dB"
+const ReplayGainTrackPeakKey = "replayGainTrackPeak"
+const ReplayGainAlbumGainKey = "replayGainAlbumGain"
+const ReplayGainAlbumPeakKey = "replayGainAlbumPeak"
+const SampleRateKey = "sampleRate" // in Hz
+const ChannelsKey = "channels"
+const BitsPerSampleKey = "bitsPerSample"
+const TotalSamplesKey = "totalSamples" // per channel
+const AudioMd5Key = "audioMd5" // MD5 of the decoded audio, from the flac stream info
+const HasArtworkKey = "hasArtwork" // "true" if there are any pictures
+const ArtworkSizeKey = "artworkSize" // size of the first picture, in bytes
+const CommentKey = "comment"
+const LyricsKey = "lyrics"
+const MusicBrainzTrackIdKey = "musicBrainzTrackId" // the recording
+const MusicBrainzAlbumIdKey = "musicBrainzAlbumId" // the release
+const MusicBrainzArtistIdKey = "musicBrainzArtistId"
+const MusicBrainzAlbumArtistIdKey = "musicBrainzAlbumArtistId"
+const MusicBrainzReleaseGroupIdKey = "musicBrainzReleaseGroupId"
+const MusicBrainzReleaseTrackIdKey = "musicBrainzReleaseTrackId"
+const EncryptedFramesKey = "encryptedFrames" // IDs of ID3v2 frames that couldn't be read
+
+// When a tag has more than one value, the values are joined with this.
+const MultiValueSeparator = "; "
 
 type TagMap map[string]string
 type TagMapSlice []TagMap
@@ -0,0 +1,65 @@
+package tags
+
+import (
+  "errors"
+  "fmt"
+  "runtime"
+)
+
+// These are the kinds of failure reported by the Read functions.  Use
+// errors.Is to test for them; the returned error is usually a *TagError
+// that wraps one of these with more detail.
+var ErrUnsupportedFormat = errors.New("unsupported format")
+var ErrTruncated = errors.New("truncated file")
+var ErrCorrupt = errors.New("corrupt structure")
+
+// TagError is returned when a file could not be read.  Path is the file
+// being read (empty when reading from an io.ReaderAt), and Err is the
+// underlying error.
+type TagError struct {
+  Path string
+  Err error
+}
+
+func (e *TagError) Error() string {
+  if e.Path == "" {
+    return e.Err.Error()
+  }
+  return e.Path + ": " + e.Err.Error()
+}
+
+func (e *TagError) Unwrap() error {
+  return e.Err
+}
+
+// The parsers are written to stop at the first problem, so rather than
+// threading an error through every read, they panic with a parseError and
+// the public entry points recover it with catch.
+type parseError struct {
+  err error
+}
+
+func fail(err error) {
+  panic(parseError{err})
+}
+
+func failf(kind error, format string, a ...interface{}) {
+  fail(fmt.Errorf("%w: %s", kind, fmt.Sprintf(format, a...)))
+}
+
+// catch must be deferred.  It turns a parseError (or an out of range index
+// caused by a bad file) into a *TagError stored in *err.
+func catch(path string, err *error) {
+  r := recover()
+  if r == nil {
+    return
+  }
+  switch e := r.(type) {
+  case parseError:
+    *err = &TagError{path, e.err}
+  case runtime.Error:
+    *err = &TagError{path, fmt.Errorf("%w: %s", ErrCorrupt, e.Error())}
+  default:
+    panic(r)
+  }
+}
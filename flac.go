@@ -1,7 +1,10 @@
 package tags
 
 import (
-  "log"
+  "bytes"
+  "encoding/hex"
+  "io"
+  "strconv"
   "strings"
 )
 
@@ -9,25 +12,39 @@ const magic = 0x664c6143
 const id3Magic = 0x49443300
 const streaminfotype byte = 0
 const commenttype byte = 4
+const picturetype byte = 6
 
 // Most of the info for this code came from this page:
 // https://xiph.org/flac/format.html
 
 func FlacTagsFromFile(path string) TagMap {
-  song := make(TagMap)
-  bb := bbFromFilePrefix(path, 256 * 1024)
+  return logTags(ReadFlacTags(path))
+}
+
+// ReadFlacTags is like FlacTagsFromFile, but returns an error rather than
+// logging it.
+func ReadFlacTags(path string) (TagMap, error) {
+  return flatten(parseFile(path, readflac, nil))
+}
+
+// ReadFlacTagsFrom reads the tags from a flac file of the given size
+// that is accessed through r.
+func ReadFlacTagsFrom(r io.ReaderAt, size int64) (TagMap, error) {
+  return flatten(parseReader("", r, size, readflac, nil))
+}
+
+func readflac(bb *bytebuffer, song MultiTagMap, pictures *[]Picture) {
   bbMagic := bb.read32BE()
-  haveComments := false
-  haveDuration := false
   if bbMagic != magic {
     // If the buffer doesn't start with an ID3 block, nothing we can do.
     if (bbMagic & 0xffffff00) != id3Magic {
-      log.Printf("flac file %s does not have correct magic number\n", path)
-      return song
+      failf(ErrUnsupportedFormat, "flac file does not have correct magic number")
+    }
+    bb.rewind() // un-read the magic
+    readID3(bb, song, pictures)
+    if bb.read32BE() != magic {
+      failf(ErrUnsupportedFormat, "flac file does not have correct magic number after ID3 block")
     }
-    bb.n = bb.n - 4 // un-read the magic
-    id3size := mp3ParseID3(bb.b, song)
-    bb.skip(uint32(id3size + 4))  // the +4 is to skip the magic
   }
   for {
     blocktype, lastone, size := nextmetablock(bb)
@@ -35,19 +52,15 @@ func FlacTagsFromFile(path string) TagMap {
       cbb := bytebufferfromparent(bb, size)
       getFlacComments(cbb, song)
       setMimeAndExtension("audio/flac", "flac", song)
-      song[EncodedExtensionKey] = "mp3"
-      song[IsEncodedKey] = "false"
-      haveComments = true
-      if haveComments && haveDuration {
-		  break
-	  }
+      song.Set(CodecKey, "flac")
+      song.Set(EncodedExtensionKey, "mp3")
+      song.Set(IsEncodedKey, "false")
     } else if blocktype == streaminfotype {
       sibb := bytebufferfromparent(bb, size)
-      getFlacDuration(sibb, song)
-      haveDuration = true
-      if haveComments && haveDuration {
-		  break
-	  }
+      getFlacStreamInfo(sibb, song)
+    } else if blocktype == picturetype {
+      pbb := bytebufferfromparent(bb, size)
+      getFlacPicture(pbb, song, pictures)
     } else {
       bb.skip(size)
     }
@@ -55,28 +68,80 @@ func FlacTagsFromFile(path string) TagMap {
       break
     }
   }
-  return song
+  // Everything after the metadata is audio.
+  setBitrate(bb.remaining64(), song)
 }
 
-func getFlacComments(cbb *bytebuffer, m TagMap) {
+// Vorbis comments are described here:
+// https://www.xiph.org/vorbis/doc/v-comment.html
+// Each comment is NAME=value.  Names are case insensitive, so we store them
+// in upper case.  The value may itself contain '=', and a name may appear
+// more than once (for several artists, say), in which case each value is
+// kept.
+func getFlacComments(cbb *bytebuffer, m MultiTagMap) {
   vendorsize := cbb.read32LE()
   cbb.skip(vendorsize)
   num := cbb.read32LE()
   for j:= 0; j < int(num); j++ {
     size := cbb.read32LE()
     comment := string(cbb.read(size))
-    parts := strings.Split(comment, "=")
-    m[parts[0]] = parts[1]
+    n := strings.Index(comment, "=")
+    // A comment without a name isn't valid, so ignore it.
+    if n <= 0 {
+      continue
+    }
+    name := strings.ToUpper(comment[:n])
+    m.Add(name, comment[n+1:])
   }
 }
 
-func getFlacDuration(bb *bytebuffer, m TagMap) {
-  bb.skip(10)
-  // We're going to do a shortcut, and assume the upper four bits of the
-  // total samples are zero.  This is good to over 750 minutes.
-  sampleSize := float64(bb.read32BE() >> 12)
-  numSamples := float64(bb.read32BE())
-  setDuration(numSamples / sampleSize, m)
+// The stream info block holds the minimum and maximum block size (16 bits
+// each) and frame size (24 bits each), then the sample rate (20 bits), the
+// number of channels minus one (3 bits), the bits per sample minus one (5 bits)
+// and the total number of samples (36 bits), and finally the MD5 signature
+// of the decoded audio.
+func getFlacStreamInfo(bb *bytebuffer, m MultiTagMap) {
+  bb.skip(10) // block and frame sizes
+  hi := bb.read32BE()
+  lo := bb.read32BE()
+  sampleRate := hi >> 12
+  channels := (hi >> 9) & 0x07 + 1
+  bitsPerSample := (hi >> 4) & 0x1f + 1
+  totalSamples := uint64(hi & 0x0f) << 32 | uint64(lo)
+  md5 := bb.read(16)
+  m.Set(SampleRateKey, strconv.FormatUint(uint64(sampleRate), 10))
+  m.Set(ChannelsKey, strconv.FormatUint(uint64(channels), 10))
+  m.Set(BitsPerSampleKey, strconv.FormatUint(uint64(bitsPerSample), 10))
+  // A total of zero means the encoder didn't know it, and an MD5 of all
+  // zeros means it wasn't computed.
+  if totalSamples > 0 {
+    m.Set(TotalSamplesKey, strconv.FormatUint(totalSamples, 10))
+  }
+  if !bytes.Equal(md5, make([]byte, 16)) {
+    m.Set(AudioMd5Key, hex.EncodeToString(md5))
+  }
+  if sampleRate > 0 {
+    setDuration(float64(totalSamples) / float64(sampleRate), m)
+  }
+}
+
+// The picture block holds the picture type, MIME type, description,
+// width, height, depth, number of colors and the image data.  The data is
+// only read if the picture is wanted.
+func getFlacPicture(pbb *bytebuffer, m MultiTagMap, pictures *[]Picture) {
+  var pic Picture
+  pic.Type = int(pbb.read32BE())
+  pic.MimeType = string(pbb.read(pbb.read32BE()))
+  pic.Description = string(pbb.read(pbb.read32BE()))
+  pic.Width = int(pbb.read32BE())
+  pic.Height = int(pbb.read32BE())
+  pic.Depth = int(pbb.read32BE())
+  pbb.skip(4) // number of colors, for indexed images
+  size := pbb.read32BE()
+  if pictures != nil {
+    pic.Data = pbb.read(size)
+  }
+  addPicture(pic, int(size), m, pictures)
 }
 
 func nextmetablock(bb *bytebuffer) (byte, bool, uint32) {
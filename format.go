@@ -0,0 +1,113 @@
+package tags
+
+import (
+  "bytes"
+  "errors"
+  "io"
+)
+
+// Format identifies the container format of a music file.
+type Format int
+
+const (
+  UnknownFormat Format = iota
+  FlacFormat
+  Mp3Format
+  M4aFormat
+)
+
+func (f Format) String() string {
+  switch f {
+  case FlacFormat:
+    return "flac"
+  case Mp3Format:
+    return "mp3"
+  case M4aFormat:
+    return "m4a"
+  }
+  return "unknown"
+}
+
+// How far past the ID3 block (or the start of the file) to look for the
+// first MPEG frame.
+const mp3SyncWindow = 64 * 1024
+
+// The largest MPEG audio frame: MPEG-2.5 Layer II at 160kbit/s and 8kHz,
+// with padding.
+const mp3MaxFrameSize = 2881
+
+// DetectFormat looks at the content of r to decide what kind of music file
+// it is.  It recognizes FLAC (with or without a leading ID3 block), MP3
+// (an ID3 block or an MPEG audio frame) and the ISO base media formats
+// (m4a, m4b, mp4 and friends, which start with an ftyp box).  Anything
+// else is UnknownFormat.  The error is only set if r could not be read.
+func DetectFormat(r io.ReaderAt) (Format, error) {
+  b, err := readAtMost(r, 0, 12)
+  if err != nil {
+    return UnknownFormat, err
+  }
+  if len(b) >= 8 && string(b[4:8]) == "ftyp" {
+    return M4aFormat, nil
+  }
+  if len(b) >= 4 && string(b[0:4]) == "fLaC" {
+    return FlacFormat, nil
+  }
+  var start int64
+  if len(b) >= 10 && string(b[0:3]) == "ID3" {
+    // Skip the ID3 block and see what follows it.
+    start = int64(10 + mp3GetID3Size(b[6:]))
+    if b[5] & 0x10 == 0x10 {
+      start += 10 // footer
+    }
+    magic, err := readAtMost(r, start, 4)
+    if err != nil {
+      return UnknownFormat, err
+    }
+    if string(magic) == "fLaC" {
+      return FlacFormat, nil
+    }
+  }
+  if findFrameSync(r, start) {
+    return Mp3Format, nil
+  }
+  return UnknownFormat, nil
+}
+
+// Looks for a valid MPEG frame header shortly after start (which is the
+// end of the ID3 block, if there is one), followed by another header right
+// after the frame, so that a stray 0xff byte doesn't count.  A frame that
+// ends the file doesn't need a second header.
+func findFrameSync(r io.ReaderAt, start int64) bool {
+  // Leave room for the largest frame after the window.
+  b, err := readAtMost(r, start, mp3SyncWindow + mp3MaxFrameSize + 4)
+  if err != nil {
+    return false
+  }
+  atEnd := len(b) < mp3SyncWindow + mp3MaxFrameSize + 4
+  for n := bytes.IndexByte(b, 0xff); n >= 0 && n < mp3SyncWindow && n <= len(b) - 4; {
+    if validHeader(b[n:n+4]) {
+      frameSize, _ := mp3ParseFrame(b[n:n+4])
+      next := n + frameSize
+      if next + 4 <= len(b) && validHeader(b[next:next+4]) || atEnd && next == len(b) {
+        return true
+      }
+    }
+    following := bytes.IndexByte(b[n+1:], 0xff)
+    if following < 0 {
+      break
+    }
+    n += following + 1
+  }
+  return false
+}
+
+// Reads up to size bytes at offset off.  Reaching the end of r is not an
+// error; the returned slice is just shorter.
+func readAtMost(r io.ReaderAt, off int64, size int) ([]byte, error) {
+  b := make([]byte, size)
+  n, err := r.ReadAt(b, off)
+  if err != nil && !errors.Is(err, io.EOF) {
+    return nil, err
+  }
+  return b[:n], nil
+}
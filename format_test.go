@@ -0,0 +1,47 @@
+package tags
+
+import (
+  "bytes"
+  "testing"
+)
+
+// Builds n padding-free MPEG-1 Layer III frames at 128kbit/s and 44.1kHz.
+func testMp3Frames(n int) []byte {
+  frame := make([]byte, 417)
+  copy(frame, testMp3Header(3, 1, 9, false))
+  return bytes.Repeat(frame, n)
+}
+
+func TestDetectFormatMp3(t *testing.T) {
+  tests := []struct {
+    name string
+    b []byte
+    format Format
+  }{
+    { "frames", testMp3Frames(3), Mp3Format },
+    { "leading zeros", append(make([]byte, 4), testMp3Frames(3)...), Mp3Format },
+    { "leading junk", append([]byte("junk\xff\x00junk"), testMp3Frames(3)...), Mp3Format },
+    { "single frame", testMp3Frames(1), Mp3Format },
+    { "stray sync", append([]byte{ 0xff, 0xfb, 0x90, 0x00 }, make([]byte, 1000)...), UnknownFormat },
+  }
+  for _, test := range tests {
+    format, err := DetectFormat(bytes.NewReader(test.b))
+    if err != nil {
+      t.Fatalf("%s: %v", test.name, err)
+    }
+    if format != test.format {
+      t.Errorf("%s: %v, want %v", test.name, format, test.format)
+    }
+  }
+}
+
+func TestReadTagsMp3WithLeadingZeros(t *testing.T) {
+  b := append(make([]byte, 4), testMp3Frames(3)...)
+  m, err := ReadTagsFrom(bytes.NewReader(b), int64(len(b)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if m[FrameCountKey] != "3" {
+    t.Errorf("frame count %q", m[FrameCountKey])
+  }
+}
@@ -0,0 +1,80 @@
+package tags
+
+import (
+  "bytes"
+  "io"
+  "io/fs"
+  "path"
+  "strings"
+)
+
+// ReadTagsFS is like ReadTags, but reads the file at path within fsys.  This
+// works with os.DirFS, embed.FS, fstest.MapFS, zip files and so on.  Since
+// path is relative to the root of fsys, it is stored in the map as
+// RelativePathKey, along with the matching BasePathKey.
+func ReadTagsFS(fsys fs.FS, path string) (TagMap, error) {
+  return flatten(ReadMultiTagsFS(fsys, path))
+}
+
+// ReadStandardTagsFS is like ReadStandardTags, but reads the file at path
+// within fsys as described for ReadTagsFS.
+func ReadStandardTagsFS(fsys fs.FS, path string) (TagMap, error) {
+  return flatten(ReadStandardMultiTagsFS(fsys, path))
+}
+
+func readFS(fsys fs.FS, name string, pictures *[]Picture) (MultiTagMap, error) {
+  f, err := fsys.Open(name)
+  if err != nil {
+    return nil, &TagError{name, err}
+  }
+  defer f.Close()
+  info, err := f.Stat()
+  if err != nil {
+    return nil, &TagError{name, err}
+  }
+  r, err := readerAt(f)
+  if err != nil {
+    return nil, &TagError{name, err}
+  }
+  return parseReader(name, r, info.Size(), readany, pictures)
+}
+
+// Most fs.File implementations (including those from os.DirFS, embed.FS
+// and fstest.MapFS) are also io.ReaderAts.  For those that can seek, we
+// seek before each read.  Anything else (such as a file in a compressed zip
+// archive) is read into memory.
+func readerAt(f fs.File) (io.ReaderAt, error) {
+  if r, ok := f.(io.ReaderAt); ok {
+    return r, nil
+  }
+  if rs, ok := f.(io.ReadSeeker); ok {
+    return &seekReaderAt{rs}, nil
+  }
+  b, err := io.ReadAll(f)
+  if err != nil {
+    return nil, err
+  }
+  return bytes.NewReader(b), nil
+}
+
+type seekReaderAt struct {
+  rs io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(b []byte, off int64) (int, error) {
+  if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+    return 0, err
+  }
+  n, err := io.ReadFull(s.rs, b)
+  if err == io.ErrUnexpectedEOF {
+    err = io.EOF
+  }
+  return n, err
+}
+
+// Base path is the relative path with the extension removed (but with the
+// trailing period retained).
+func setPaths(relativePath string, m MultiTagMap) {
+  m.Set(RelativePathKey, relativePath)
+  m.Set(BasePathKey, strings.TrimSuffix(relativePath, path.Ext(relativePath)) + ".")
+}
@@ -2,4 +2,4 @@ module github.com/brothertoad/tags
 
 go 1.20
 
-require golang.org/x/text v0.14.0 // indirect
+require golang.org/x/text v0.14.0
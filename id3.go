@@ -0,0 +1,526 @@
+package tags
+
+import (
+  "bytes"
+  "compress/zlib"
+  "encoding/binary"
+  "io"
+  "io/ioutil"
+  "strconv"
+  "strings"
+  "golang.org/x/text/transform"
+  "golang.org/x/text/encoding/unicode"
+)
+
+// Text encodings used by ID3v2 frames.
+const id3Latin1 byte = 0
+const id3UTF16 byte = 1 // with BOM
+const id3UTF16BE byte = 2 // without BOM, v2.4 only
+const id3UTF8 byte = 3 // v2.4 only
+
+// MP3 ID3 blocks are described here:
+// https://id3.org/id3v2.3.0
+// https://id3.org/id3v2.4.0-structure
+// https://id3.org/id3v2.4.0-frames
+// The encodings are listed here:
+// https://stackoverflow.com/questions/9857727/text-encoding-in-id3v2-3-tags
+// Returns the size of the block, not counting a v2.4 footer.
+func mp3ParseID3(buffer []byte, m MultiTagMap, pictures *[]Picture) int {
+  major := buffer[3]
+  flags := buffer[5]
+  eob := 10 + mp3GetID3Size(buffer[6:]) // eob means end of buffer
+  if eob > len(buffer) {
+    failf(ErrTruncated, "ID3 block of %d bytes runs past end of file", eob)
+  }
+  body := buffer[10:eob]
+  // With unsynchronisation, the encoder put a zero byte after every 0xff so
+  // the tag can't be mistaken for a frame sync.  Before v2.4 this was done
+  // to the whole tag; in v2.4 it's done to each frame, and this flag just
+  // means every frame is unsynchronised.
+  unsync := flags & 0x80 == 0x80
+  if unsync && major < 4 {
+    body = id3Resync(body)
+  }
+  if major == 2 {
+    // In v2.2, this flag means the tag is compressed, but no compression
+    // scheme was ever defined, so the tag can't be read.
+    if flags & 0x40 == 0 {
+      mp3ParseID3v22(body, m, pictures)
+    }
+    return eob
+  }
+  // Other than v2.2, we only know how to read the frames of v2.3 and v2.4.
+  if major != 3 && major != 4 {
+    return eob
+  }
+  // Check for extended header.  In v2.3 the size doesn't include the size
+  // field itself; in v2.4 it does, and is syncsafe.
+  if flags & 0x40 == 0x40 {
+    var extSize int
+    if major == 4 {
+      extSize = mp3GetID3Size(body)
+    } else {
+      extSize = 4 + int(binary.BigEndian.Uint32(body[0:4]))
+    }
+    if extSize > len(body) {
+      failf(ErrCorrupt, "ID3 extended header of %d bytes runs past end of block", extSize)
+    }
+    body = body[extSize:]
+  }
+  // Read frames until we're through.  Each frame has a ten byte header: the
+  // four character ID, the size and two bytes of flags.
+  for j := 0; j + 10 <= len(body); {
+    // If we find a zero byte, we're at the padding after the frames.
+    if body[j] == 0 {
+      break
+    }
+    key := string(body[j:j+4])
+    var size int
+    if major == 4 {
+      size = id3v24FrameSize(body, j)
+    } else {
+      size = int(binary.BigEndian.Uint32(body[j+4:j+8]))
+    }
+    // Taggers sometimes leave a damaged frame at the end; keep what we have.
+    if size > len(body) - j - 10 {
+      break
+    }
+    frameFlags := binary.BigEndian.Uint16(body[j+8:j+10])
+    if data := id3FrameData(major, key, frameFlags, unsync, body[j+10:j+10+size], m); data != nil {
+      id3Frame(key, data, m, pictures)
+    }
+    j += size + 10
+  }
+  return eob
+}
+
+// Frame flags for v2.3 and v2.4.  The status flags (the first byte) don't
+// affect how the frame is read.
+const id3v23Compressed uint16 = 0x0080
+const id3v23Encrypted uint16 = 0x0040
+const id3v23Grouped uint16 = 0x0020
+const id3v24Grouped uint16 = 0x0040
+const id3v24Compressed uint16 = 0x0008
+const id3v24Encrypted uint16 = 0x0004
+const id3v24Unsynchronised uint16 = 0x0002
+const id3v24DataLength uint16 = 0x0001
+
+// The most a compressed frame may decompress to, whatever size it gives.
+const id3MaxDecompressed = 16 << 20
+
+// Undoes whatever the frame flags say was done to the frame data.  Returns
+// nil if the frame can't be read.  Encrypted frames can't be read, so they
+// are listed under EncryptedFramesKey instead.
+func id3FrameData(major byte, key string, flags uint16, unsync bool, data []byte, m MultiTagMap) []byte {
+  var compressed, encrypted bool
+  size := id3MaxDecompressed
+  if major == 4 {
+    compressed = flags & id3v24Compressed != 0
+    encrypted = flags & id3v24Encrypted != 0
+    if unsync || flags & id3v24Unsynchronised != 0 {
+      data = id3Resync(data)
+    }
+    // The extra bytes after the header are in this order: group ID,
+    // encryption method and data length indicator.
+    extra := 0
+    if flags & id3v24Grouped != 0 {
+      extra++
+    }
+    if encrypted {
+      extra++
+    }
+    if flags & id3v24DataLength != 0 {
+      extra += 4
+    }
+    if extra > len(data) {
+      return nil
+    }
+    if flags & id3v24DataLength != 0 {
+      if n := mp3GetID3Size(data[extra-4:extra]); n < size {
+        size = n
+      }
+    }
+    data = data[extra:]
+  } else {
+    compressed = flags & id3v23Compressed != 0
+    encrypted = flags & id3v23Encrypted != 0
+    // The extra bytes after the header are in this order: decompressed
+    // size, encryption method and group ID.
+    extra := 0
+    if compressed {
+      extra += 4
+    }
+    if encrypted {
+      extra++
+    }
+    if flags & id3v23Grouped != 0 {
+      extra++
+    }
+    if extra > len(data) {
+      return nil
+    }
+    if compressed {
+      if n := int(binary.BigEndian.Uint32(data[0:4])); n < size {
+        size = n
+      }
+    }
+    data = data[extra:]
+  }
+  if encrypted {
+    m.Add(EncryptedFramesKey, key)
+    return nil
+  }
+  if compressed {
+    // A frame that doesn't decompress, or decompresses to more than it
+    // says it should, is skipped, like a damaged frame.
+    zr, err := zlib.NewReader(bytes.NewReader(data))
+    if err != nil {
+      return nil
+    }
+    data, err = ioutil.ReadAll(io.LimitReader(zr, int64(size) + 1))
+    if err != nil || len(data) > size {
+      return nil
+    }
+  }
+  return data
+}
+
+// Reverses unsynchronisation by removing the zero byte that follows each 0xff.
+func id3Resync(b []byte) []byte {
+  if bytes.IndexByte(b, 0xff) < 0 {
+    return b
+  }
+  out := make([]byte, 0, len(b))
+  for j := 0; j < len(b); j++ {
+    out = append(out, b[j])
+    if b[j] == 0xff && j + 1 < len(b) && b[j+1] == 0 {
+      j++
+    }
+  }
+  return out
+}
+
+// Version 2.2 is described here:
+// https://id3.org/id3v2-00
+// Frames have a six byte header: a three character ID and a three byte size.
+// There are no frame flags.
+func mp3ParseID3v22(body []byte, m MultiTagMap, pictures *[]Picture) {
+  for j := 0; j + 6 <= len(body); {
+    if body[j] == 0 {
+      break
+    }
+    key := string(body[j:j+3])
+    size := int(body[j+3]) << 16 | int(body[j+4]) << 8 | int(body[j+5])
+    if size > len(body) - j - 6 {
+      break
+    }
+    id3Frame(key, body[j+6:j+6+size], m, pictures)
+    j += size + 6
+  }
+}
+
+// In v2.4 frame sizes are syncsafe, but some taggers (older versions of
+// iTunes in particular) wrote them as plain integers.  If the syncsafe size
+// doesn't lead to another frame but the plain one does, use the plain one.
+func id3v24FrameSize(body []byte, j int) int {
+  size := mp3GetID3Size(body[j+4:])
+  plain := int(binary.BigEndian.Uint32(body[j+4:j+8]))
+  if plain == size || id3FrameFollows(body, j + 10 + size) {
+    return size
+  }
+  if id3FrameFollows(body, j + 10 + plain) {
+    return plain
+  }
+  return size
+}
+
+// Returns true if offset j is the end of the frames, the start of the
+// padding or the start of a frame.
+func id3FrameFollows(body []byte, j int) bool {
+  if j == len(body) {
+    return true
+  }
+  if j < 0 || j + 4 > len(body) {
+    return false
+  }
+  if body[j] == 0 {
+    return true
+  }
+  for _, c := range body[j:j+4] {
+    if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+      return false
+    }
+  }
+  return true
+}
+
+// Adds the value of a frame to m.  Text frames are keyed by their ID.  The
+// frames that can appear more than once, distinguished by a description,
+// are keyed by ID and description: user text (TXXX) as "TXXX:<description>",
+// and comments (COMM) and lyrics (USLT), which also have a language, as
+// "COMM:<language>:<description>", as in "COMM:eng:".  A missing language is
+// given as "XXX".  Unique file identifiers (UFID) are keyed as "UFID:<owner>".  The v2.2 frames (TXX, COM, ULT and UFI) are
+// keyed the same way, with their three character IDs.  Pictures (APIC and
+// PIC) are passed to addPicture.
+func id3Frame(key string, data []byte, m MultiTagMap, pictures *[]Picture) {
+  if len(data) == 0 {
+    return
+  }
+  switch key {
+  case "TXXX", "TXX":
+    // encoding, description, value
+    description, value := id3SplitString(data[0], data[1:])
+    id3AddValues(m, key + ":" + description, data[0], value)
+  case "COMM", "COM", "USLT", "ULT":
+    // encoding, three character language, description, value
+    if len(data) < 4 {
+      return
+    }
+    language := strings.TrimRight(stringFromLatin1(data[1:4]), "\000 ")
+    if language == "" {
+      language = "XXX"
+    }
+    description, value := id3SplitString(data[0], data[4:])
+    m.Add(key + ":" + language + ":" + description, id3Text(data[0], value))
+  case "APIC":
+    // encoding, MIME type (always ISO-8859-1), picture type, description, image
+    mimeType, rest := id3SplitString(id3Latin1, data[1:])
+    if len(rest) == 0 {
+      return
+    }
+    description, image := id3SplitString(data[0], rest[1:])
+    pic := Picture{MimeType: imageMimeType(mimeType), Type: int(rest[0]), Description: description, Data: image}
+    addPicture(pic, len(image), m, pictures)
+  case "PIC":
+    // encoding, three character image format (such as "JPG"), picture type,
+    // description, image
+    if len(data) < 5 {
+      return
+    }
+    description, image := id3SplitString(data[0], data[5:])
+    pic := Picture{MimeType: imageMimeType(string(data[1:4])), Type: int(data[4]), Description: description, Data: image}
+    addPicture(pic, len(image), m, pictures)
+  case "UFID", "UFI":
+    // owner (always ISO-8859-1), binary identifier of up to 64 bytes
+    owner, id := id3SplitString(id3Latin1, data)
+    m.Set(key + ":" + owner, string(id))
+  default:
+    if strings.HasPrefix(key, "T") {
+      id3AddValues(m, key, data[0], data[1:])
+    }
+  }
+}
+
+// ID3v2.4 text frames can hold several values, each terminated by a zero
+// byte (two for UTF-16); a frame repeated in an older tag does the same job.
+// Empty values are padding, unless there is nothing else.
+func id3AddValues(m MultiTagMap, key string, encoding byte, b []byte) {
+  added := false
+  for len(b) > 0 {
+    var value string
+    value, b = id3SplitString(encoding, b)
+    if value != "" {
+      m.Add(key, value)
+      added = true
+    }
+  }
+  if _, present := m[key]; !present && !added {
+    m.Set(key, "")
+  }
+}
+
+// Splits a zero terminated string in the given encoding from the start of b,
+// and returns it and the bytes that follow the terminator.  In UTF-16, the
+// terminator is two zero bytes.
+func id3SplitString(encoding byte, b []byte) (string, []byte) {
+  if encoding == id3UTF16 || encoding == id3UTF16BE {
+    for j := 0; j + 1 < len(b); j += 2 {
+      if b[j] == 0 && b[j+1] == 0 {
+        return id3Text(encoding, b[:j]), b[j+2:]
+      }
+    }
+  } else if n := bytes.IndexByte(b, 0); n >= 0 {
+    return id3Text(encoding, b[:n]), b[n+1:]
+  }
+  return id3Text(encoding, b), nil
+}
+
+// Decodes a string in one of the ID3v2 text encodings.
+func id3Text(encoding byte, b []byte) string {
+  var value string
+  switch encoding {
+  case id3Latin1:
+    value = stringFromLatin1(b)
+  case id3UTF16:
+    value = stringFromUTF16(b)
+  case id3UTF16BE:
+    value = stringFromUTF16BE(b)
+  default:
+    value = string(b)
+  }
+  // Some tags have a zero byte (or two, for UTF-16) at the end to terminate
+  // the string or make it an even length.  We need to remove them.
+  return strings.TrimRight(value, "\000")
+}
+
+// Reads an ID3 block from the buffer, which must be positioned at the
+// "ID3" that starts it.
+func readID3(bb *bytebuffer, m MultiTagMap, pictures *[]Picture) {
+  header := bb.peekn(10)
+  size := 10 + mp3GetID3Size(header[6:])
+  if header[5] & 0x10 == 0x10 {
+    size += 10 // footer
+  }
+  mp3ParseID3(bb.read(uint32(size)), m, pictures)
+}
+
+// ID3v1 tags are the last 128 bytes of the file.  An Enhanced tag (TAG+)
+// may be in the 227 bytes before that.  They are described here:
+// https://id3.org/ID3v1
+// https://en.wikipedia.org/wiki/ID3#Enhanced_tag
+// Since ID3v2 tags hold more (and longer) values, the values from ID3v1 only
+// fill in frames that ID3v2 didn't provide.  The enhanced tag holds the parts
+// of the title, artist and album that didn't fit in the ID3v1 tag, and the
+// genre as text, which wins over the ID3v1 genre number.
+func readID3v1(bb *bytebuffer, m MultiTagMap) {
+  trailer := bb.tail(128 + 227)
+  if len(trailer) < 128 {
+    return
+  }
+  tag := trailer[len(trailer)-128:]
+  if string(tag[0:3]) != "TAG" {
+    return
+  }
+  title := id3v1String(tag[3:33])
+  artist := id3v1String(tag[33:63])
+  album := id3v1String(tag[63:93])
+  year := id3v1String(tag[93:97])
+  comment := tag[97:127]
+  track := 0
+  // In v1.1, a zero byte near the end of the comment is followed by the track.
+  if comment[28] == 0 && comment[29] != 0 {
+    track = int(comment[29])
+    comment = comment[:28]
+  }
+  genre := id3v1Genre(int(tag[127]))
+  if len(trailer) == 128 + 227 && string(trailer[0:4]) == "TAG+" {
+    plus := trailer[0:227]
+    title += id3v1String(plus[4:64])
+    artist += id3v1String(plus[64:124])
+    album += id3v1String(plus[124:184])
+    if g := id3v1String(plus[185:215]); g != "" {
+      genre = g
+    }
+  }
+  id3v1Fill(m, title, "TIT2", "TT2")
+  id3v1Fill(m, artist, "TPE1", "TP1")
+  id3v1Fill(m, album, "TALB", "TAL")
+  id3v1Fill(m, year, "TYER", "TDRC", "TYE")
+  if !id3HasComment(m) {
+    id3v1Fill(m, id3v1String(comment), "COMM:XXX:")
+  }
+  if track > 0 {
+    id3v1Fill(m, strconv.Itoa(track), "TRCK", "TRK")
+  }
+  id3v1Fill(m, genre, "TCON", "TCO")
+}
+
+// ID3v2.3 genres can be an ID3v1 genre number in parentheses, optionally
+// followed by a more specific name, such as "(4)Eurodisco"; "((" starts a
+// name that begins with a parenthesis.  ID3v2.4 uses the bare number.
+// Returns the name.
+func id3Genre(s string) string {
+  if strings.HasPrefix(s, "((") {
+    return s[1:]
+  }
+  if strings.HasPrefix(s, "(") {
+    if n := strings.Index(s, ")"); n > 0 {
+      if rest := s[n+1:]; rest != "" {
+        return rest
+      }
+      s = s[1:n]
+    }
+  }
+  if index, err := strconv.Atoi(s); err == nil && id3v1Genre(index) != "" {
+    return id3v1Genre(index)
+  }
+  switch s {
+  case "RX":
+    return "Remix"
+  case "CR":
+    return "Cover"
+  }
+  return s
+}
+
+// Sets the first key to value, unless value is empty or ID3v2 provided
+// any of the keys.
+func id3v1Fill(m MultiTagMap, value string, keys ...string) {
+  if value == "" {
+    return
+  }
+  for _, key := range keys {
+    if _, present := m[key]; present {
+      return
+    }
+  }
+  m.Set(keys[0], value)
+}
+
+// Reports whether m has a comment frame, in any language and with any
+// description.
+func id3HasComment(m MultiTagMap) bool {
+  for k := range m {
+    if strings.HasPrefix(k, "COMM:") || strings.HasPrefix(k, "COM:") {
+      return true
+    }
+  }
+  return false
+}
+
+// ID3v1 strings are ISO-8859-1, padded with zero bytes or spaces.
+func id3v1String(b []byte) string {
+  if n := bytes.IndexByte(b, 0); n >= 0 {
+    b = b[:n]
+  }
+  return strings.TrimRight(stringFromLatin1(b), " ")
+}
+
+// ISO-8859-1 maps each byte to the Unicode code point with the same value.
+func stringFromLatin1(b []byte) string {
+  runes := make([]rune, len(b))
+  for j, c := range b {
+    runes[j] = rune(c)
+  }
+  return string(runes)
+}
+
+// TASK: move this to btu
+func stringFromUTF16(b []byte) string {
+  return decodeUTF16(b, unicode.UseBOM)
+}
+
+func stringFromUTF16BE(b []byte) string {
+  return decodeUTF16(b, unicode.IgnoreBOM)
+}
+
+func decodeUTF16(b []byte, bom unicode.BOMPolicy) string {
+  bomEncoder := unicode.UTF16(unicode.BigEndian, bom)
+  bomReader := transform.NewReader(bytes.NewReader(b), bomEncoder.NewDecoder())
+  decoded, err := ioutil.ReadAll(bomReader)
+  if err != nil {
+    failf(ErrCorrupt, "unable to get a string from UTF16: %s", err)
+  }
+  s := string(decoded)
+  return s
+}
+
+func mp3GetID3Size(b []byte) int {
+  // Read four bytes, use the lower 7 bits of each one to form a 28-bit size.
+  var total int = 0
+  for j := 0; j < 4; j++ {
+    total <<= 7
+    total += int(b[j]) & 0x7f
+  }
+  return total
+}
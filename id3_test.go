@@ -0,0 +1,53 @@
+package tags
+
+import (
+  "bytes"
+  "compress/zlib"
+  "testing"
+)
+
+func TestId3FrameCommentLanguages(t *testing.T) {
+  m := make(MultiTagMap)
+  id3Frame("COMM", []byte("\x00engNote\x00English"), m, nil)
+  id3Frame("COMM", []byte("\x00deuNote\x00Deutsch"), m, nil)
+  id3Frame("COMM", []byte("\x00engNote\x00More"), m, nil)
+  id3Frame("USLT", []byte("\x00eng\x00Words"), m, nil)
+  id3Frame("COMM", []byte("\x00\x00\x00\x00\x00Unknown"), m, nil)
+  if got := m.GetAll("COMM:eng:Note"); len(got) != 2 || got[0] != "English" || got[1] != "More" {
+    t.Errorf("COMM:eng:Note = %q", got)
+  }
+  if m.Get("COMM:deu:Note") != "Deutsch" || m.Get("USLT:eng:") != "Words" || m.Get("COMM:XXX:") != "Unknown" {
+    t.Errorf("keys: %v", m)
+  }
+  if len(m) != 4 {
+    t.Errorf("%d keys, want 4: %v", len(m), m)
+  }
+  translateMultiKeys(m)
+  if m.Get(CommentKey) != "Unknown" || m.Get(LyricsKey) != "Words" || m.Get("COMM:deu:Note") != "Deutsch" {
+    t.Errorf("standard keys: %v", m)
+  }
+}
+
+func TestId3FrameDataCompressedSize(t *testing.T) {
+  var z bytes.Buffer
+  zw := zlib.NewWriter(&z)
+  zw.Write([]byte("\x00Some text"))
+  zw.Close()
+  for _, test := range []struct {
+    major byte
+    flags uint16
+    size []byte
+    ok bool
+  }{
+    { 3, id3v23Compressed, []byte{ 0, 0, 0, 10 }, true },
+    { 3, id3v23Compressed, []byte{ 0, 0, 0, 4 }, false },
+    { 4, id3v24Compressed | id3v24DataLength, []byte{ 0, 0, 0, 10 }, true },
+    { 4, id3v24Compressed | id3v24DataLength, []byte{ 0, 0, 0, 4 }, false },
+    { 4, id3v24Compressed, nil, true },
+  } {
+    data := id3FrameData(test.major, "TIT2", test.flags, false, append(test.size, z.Bytes()...), make(MultiTagMap))
+    if (data != nil) != test.ok || test.ok && string(data) != "\x00Some text" {
+      t.Errorf("v2.%d, flags %#x, size %v: %q", test.major, test.flags, test.size, data)
+    }
+  }
+}
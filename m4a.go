@@ -1,7 +1,11 @@
 package tags
 
 import (
+  "encoding/binary"
   "fmt"
+  "io"
+  "strconv"
+  "strings"
 )
 
 const moov = "moov"
@@ -9,9 +13,29 @@ const mvhd = "mvhd"
 const udta = "udta"
 const meta = "meta"
 const ilst = "ilst"
+const mdhd = "mdhd"
+const edts = "edts"
+const elst = "elst"
 
 const trackkey = "trkn"
 const diskkey = "disk"
+const coverkey = "covr"
+const genrekey = "gnre"
+const freeformkey = "----"
+const smpbkey = "com.apple.iTunes:iTunSMPB"
+
+// The types of the values in data atoms.
+const m4aImplicit = 0
+const m4aUTF8 = 1
+const m4aUTF16 = 2
+const m4aJPEG = 13
+const m4aPNG = 14
+const m4aSigned = 21
+const m4aUnsigned = 22
+const m4aBMP = 27
+
+// Items that are flags rather than numbers.
+var m4aBooleans = map[string]bool{ "cpil": true, "pgap": true }
 
 // Most of the info for this code came from these pages:
 // https://developer.apple.com/library/archive/documentation/QuickTime/QTFF/QTFFChap2/qtff2.html
@@ -19,78 +43,374 @@ const diskkey = "disk"
 // https://www.file-recovery.com/m4a-signature-format.htm
 
 func M4aTagsFromFile(path string) TagMap {
-  bb := bytebufferfromfile(path)
-  m := make(TagMap)
+  return logTags(ReadM4aTags(path))
+}
+
+// ReadM4aTags is like M4aTagsFromFile, but returns an error rather than
+// logging it.
+func ReadM4aTags(path string) (TagMap, error) {
+  return flatten(parseFile(path, readm4a, nil))
+}
+
+// ReadM4aTagsFrom reads the tags from an m4a file of the given size
+// that is accessed through r.
+func ReadM4aTagsFrom(r io.ReaderAt, size int64) (TagMap, error) {
+  return flatten(parseReader("", r, size, readm4a, nil))
+}
+
+func readm4a(bb *bytebuffer, m MultiTagMap, pictures *[]Picture) {
+  // Walk the top-level boxes until we find moov, which may come before or
+  // after the audio in mdat.  Only the box headers are read on the way, so
+  // mdat is skipped over without being read.  The whole of moov is then read
+  // at once.
   moovatom := findatom(bb, moov)
-  udtaatom := findatom(moovatom, udta)
-  metaatom := findatom(udtaatom, meta)
-  // We need to skip four bytes from the meta atom
-  metaatom.skip(4)
-  ilstatom := findatom(metaatom, ilst)
-  readm4atags(ilstatom, m)
-  // Now, find the mvhd atom with the moov atom to get the duration.
+  if moovatom == nil {
+    failf(ErrCorrupt, "no %s atom", moov)
+  }
+  moovatom.load()
+  // A file that hasn't been tagged (a fresh encode, say) may not have any of
+  // udta, meta and ilst.  That just means there are no tags.
+  if ilstatom := findilst(moovatom); ilstatom != nil {
+    readm4atags(ilstatom, m, pictures)
+  }
+  getM4aAudio(moovatom, m)
   getM4aDuration(moovatom, m)
-  setMimeAndExtension("audio/aac", "m4a", m)
-  m[EncodedExtensionKey] = "m4a"
-  m[IsEncodedKey] = "true"
-  return m
 }
 
-func readm4atags(bb *bytebuffer, m TagMap) {
-  keys := [...]string{ "\xa9nam", "\xa9ART", "\xa9alb", "soar", "soal" }
+// Every item in the ilst atom is read, using the type of its data atoms,
+// so that new items need only an entry in keyTranslations.
+func readm4atags(bb *bytebuffer, m MultiTagMap, pictures *[]Picture) {
   for bb.remaining() > 0 {
-    size := bb.read32BE();
-    atomtype := string(bb.read(4))
-    found := false
-    // Look for text keys first
-    for _, key := range keys {
-      if atomtype == key {
-        // Skip 16 bytes, which is the size of the data, the word "data", the type and locale
-        bb.skip(16)
-        value := string(bb.read(size - 24))
-        m[key] = value
-        found = true
+    atomtype, size := nextatom(bb)
+    item := bytebufferfromparent64(bb, size)
+    switch atomtype {
+    case trackkey, diskkey:
+      // Handle trkn and disk separate, since they are funky.
+      for _, data := range getM4aData(item) {
+        m.Add(atomtype, m4aNumberAndTotal(data.value))
+      }
+    case genrekey:
+      // gnre is one more than an ID3v1 genre index.
+      for _, data := range getM4aData(item) {
+        if n, ok := m4aInteger(data); ok && id3v1Genre(int(n) - 1) != "" {
+          m.Add(atomtype, id3v1Genre(int(n) - 1))
+        }
+      }
+    case coverkey:
+      getM4aCovers(item, m, pictures)
+    case freeformkey:
+      key := getM4aFreeformKey(item)
+      for _, data := range getM4aData(item) {
+        if value, ok := m4aValue(key, data); ok {
+          m.Add(key, value)
+        }
+      }
+    default:
+      for _, data := range getM4aData(item) {
+        if value, ok := m4aValue(atomtype, data); ok {
+          m.Add(atomtype, value)
+        }
       }
     }
-    if !found {
-      // Handle trkn and disk separate, since they are funky.
-      if atomtype == trackkey {
-        bb.skip(18)
-        track := bb.read16BE()
-        bb.skip(4)
-        m[trackkey] = fmt.Sprintf("%d", track)
-        found = true
-      } else if atomtype == diskkey {
-        bb.skip(18) // note: skip first byte of trkn
-        disk := bb.read16BE()
-        bb.skip(2)
-        m[diskkey] = fmt.Sprintf("%d", disk)
-        found = true
+  }
+}
+
+// Converts the value of a data atom to a string, or returns false if the
+// value isn't text or a number.
+func m4aValue(key string, data m4adata) (string, bool) {
+  switch data.datatype {
+  case m4aUTF8:
+    return string(data.value), true
+  case m4aUTF16:
+    return stringFromUTF16BE(data.value), true
+  }
+  n, ok := m4aInteger(data)
+  if !ok {
+    return "", false
+  }
+  if m4aBooleans[key] {
+    return strconv.FormatBool(n != 0), true
+  }
+  return strconv.FormatInt(n, 10), true
+}
+
+// Integers are big endian, and one, two, three, four or eight bytes long.
+// Values with the implicit type (such as gnre) are unsigned.
+func m4aInteger(data m4adata) (int64, bool) {
+  if data.datatype != m4aSigned && data.datatype != m4aUnsigned && data.datatype != m4aImplicit {
+    return 0, false
+  }
+  size := len(data.value)
+  if size == 0 || size > 8 || size > 4 && size < 8 {
+    return 0, false
+  }
+  var u uint64
+  for _, b := range data.value {
+    u = u << 8 | uint64(b)
+  }
+  if data.datatype == m4aSigned {
+    // Sign extend.
+    shift := 64 - 8 * size
+    return int64(u << shift) >> shift, true
+  }
+  return int64(u), true
+}
+
+// An item in the ilst atom holds a data atom for each of its values.
+type m4adata struct {
+  datatype uint32
+  value []byte
+}
+
+// Each data atom has its size, the word "data", a byte of version and three
+// of type, then four bytes of locale, and then the value.  Other atoms (such
+// as the mean and name atoms of a freeform item) are skipped.
+func getM4aData(bb *bytebuffer) []m4adata {
+  var values []m4adata
+  for bb.remaining() > 0 {
+    atomtype, size := nextatom(bb)
+    if atomtype != "data" || size < 8 {
+      bb.skip64(size)
+      continue
+    }
+    datatype := bb.read32BE() & 0x00ffffff
+    bb.skip(4) // locale
+    values = append(values, m4adata{datatype, bb.read(uint32(size - 8))})
+  }
+  return values
+}
+
+// A freeform item has a mean atom, which holds a reverse DNS domain such as
+// "com.apple.iTunes", and a name atom, before its data atoms.  Both hold
+// four bytes of version and flags and then a string.  The key is the two
+// strings joined with a colon, as in "com.apple.iTunes:iTunSMPB".  The
+// buffer is rewound, ready for getM4aData.
+func getM4aFreeformKey(bb *bytebuffer) string {
+  var mean, name string
+  for bb.remaining() > 0 {
+    atomtype, size := nextatom(bb)
+    if (atomtype == "mean" || atomtype == "name") && size >= 4 {
+      bb.skip(4)
+      value := string(bb.read(uint32(size - 4)))
+      if atomtype == "mean" {
+        mean = value
+      } else {
+        name = value
       }
+    } else {
+      bb.skip64(size)
     }
-    if !found {
-      bb.skip(size - 8)
+  }
+  bb.rewind()
+  return mean + ":" + name
+}
+
+// The trkn and disk values are two bytes of padding, then the number and the
+// total (two bytes each).  The total is zero if it isn't known, and trkn
+// has another two bytes of padding.  The result is in the same form as the
+// ID3v2 TRCK frame.
+func m4aNumberAndTotal(b []byte) string {
+  if len(b) < 4 {
+    return ""
+  }
+  number := binary.BigEndian.Uint16(b[2:4])
+  if len(b) >= 6 {
+    if total := binary.BigEndian.Uint16(b[4:6]); total > 0 {
+      return fmt.Sprintf("%d/%d", number, total)
+    }
+  }
+  return fmt.Sprintf("%d", number)
+}
+
+// The covr atom holds a data atom for each image.  The type of the data
+// gives the format of the image.
+func getM4aCovers(bb *bytebuffer, m MultiTagMap, pictures *[]Picture) {
+  for _, data := range getM4aData(bb) {
+    image := data.value
+    var pic Picture
+    switch data.datatype {
+    case m4aJPEG:
+      pic.MimeType = "image/jpeg"
+    case m4aPNG:
+      pic.MimeType = "image/png"
+    case m4aBMP:
+      pic.MimeType = "image/bmp"
+    }
+    pic.Type = FrontCoverPicture
+    pic.Data = image
+    addPicture(pic, len(image), m, pictures)
+  }
+}
+
+// The duration comes from the media header of the audio track, since its
+// time scale is normally the sample rate, which makes it exact.  The movie
+// header is only used if there is no audio track.  The media includes the
+// samples an AAC encoder adds at the start and end, so these are taken
+// off: iTunes records them in iTunSMPB, and other encoders use an edit list.
+func getM4aDuration(moovatom *bytebuffer, m MultiTagMap) {
+  moovatom.rewind()
+  var movieScale, movieDuration uint64
+  if mvhdatom := findatom(moovatom, mvhd); mvhdatom != nil {
+    movieScale, movieDuration = getM4aTimes(mvhdatom)
+  }
+  trakatom := findaudiotrak(moovatom)
+  var mdhdatom *bytebuffer
+  if trakatom != nil {
+    mdhdatom = findpath(trakatom, mdia, mdhd)
+  }
+  if mdhdatom == nil {
+    if movieScale > 0 {
+      setDuration(float64(movieDuration) / float64(movieScale), m)
     }
+    return
+  }
+  scale, samples := getM4aTimes(mdhdatom)
+  if scale == 0 {
+    return
+  }
+  var delay, padding uint64
+  if d, p, original, ok := parseItunSmpb(m.Get(smpbkey)); ok && d + p + original <= samples {
+    delay, padding, samples = d, p, original
+  } else {
+    trakatom.rewind()
+    if elstatom := findpath(trakatom, edts, elst); elstatom != nil && movieScale > 0 {
+      if mediaTime, segment, ok := getM4aEdit(elstatom); ok {
+        // The length of the edit is in the movie's time scale.
+        presented := segment * scale / movieScale
+        if presented > 0 && mediaTime + presented <= samples {
+          delay, padding, samples = mediaTime, samples - mediaTime - presented, presented
+        }
+      }
+    }
+  }
+  if delay > 0 || padding > 0 {
+    m.Set(EncoderDelayKey, strconv.FormatUint(delay, 10))
+    m.Set(EncoderPaddingKey, strconv.FormatUint(padding, 10))
+  }
+  setDuration(float64(samples) / float64(scale), m)
+}
+
+// The movie and media headers start with a version and three bytes of
+// flags, then the creation and modification times, the time scale and the
+// duration.  The times and duration are four bytes in version 0 and eight
+// in version 1.  A duration of all ones means it isn't known.
+func getM4aTimes(bb *bytebuffer) (uint64, uint64) {
+  version := bb.readByte()
+  bb.skip(3)
+  var duration uint64
+  if version == 1 {
+    bb.skip(16)
+    scale := uint64(bb.read32BE())
+    if duration = bb.read64BE(); duration == 0xffffffffffffffff {
+      duration = 0
+    }
+    return scale, duration
+  }
+  bb.skip(8)
+  scale := uint64(bb.read32BE())
+  if duration = uint64(bb.read32BE()); duration == 0xffffffff {
+    duration = 0
   }
+  return scale, duration
 }
 
-func getM4aDuration(mbb *bytebuffer, m TagMap) {
-  mbb.rewind()
-  mvhdatom := findatom(mbb, mvhd)
-  mvhdatom.skip(12)
-  timeUnit := float64(mvhdatom.read32BE())
-  units := float64(mvhdatom.read32BE())
-  setDuration(units / timeUnit, m)
+// An edit list has a version, flags and the number of edits.  Each edit
+// has a length (in the movie's time scale), the time in the media at which
+// it starts (-1 for an empty edit, which delays the start) and a rate.
+// These are four bytes each in version 0; the first two are eight in
+// version 1.  Returns the start and length of the first edit that isn't
+// empty.
+func getM4aEdit(bb *bytebuffer) (uint64, uint64, bool) {
+  version := bb.readByte()
+  bb.skip(3)
+  count := bb.read32BE()
+  for j := uint32(0); j < count; j++ {
+    var segment uint64
+    var mediaTime int64
+    if version == 1 {
+      segment = bb.read64BE()
+      mediaTime = int64(bb.read64BE())
+    } else {
+      segment = uint64(bb.read32BE())
+      mediaTime = int64(int32(bb.read32BE()))
+    }
+    bb.skip(4) // rate
+    if mediaTime >= 0 {
+      return uint64(mediaTime), segment, true
+    }
+  }
+  return 0, 0, false
+}
+
+// iTunSMPB is a string of hexadecimal numbers.  The second and third are
+// the samples added at the start and at the end, and the fourth is the
+// number of samples of the original audio.
+func parseItunSmpb(s string) (uint64, uint64, uint64, bool) {
+  fields := strings.Fields(s)
+  if len(fields) < 4 {
+    return 0, 0, 0, false
+  }
+  var values [3]uint64
+  for j := range values {
+    v, err := strconv.ParseUint(fields[j+1], 16, 64)
+    if err != nil {
+      return 0, 0, 0, false
+    }
+    values[j] = v
+  }
+  if values[2] == 0 {
+    return 0, 0, 0, false
+  }
+  return values[0], values[1], values[2], true
+}
+
+// The tags are in moov/udta/meta/ilst.  Returns nil if any of them is missing.
+func findilst(moovatom *bytebuffer) *bytebuffer {
+  udtaatom := findatom(moovatom, udta)
+  if udtaatom == nil {
+    return nil
+  }
+  metaatom := findatom(udtaatom, meta)
+  if metaatom == nil {
+    return nil
+  }
+  // In MP4, meta has four bytes of version and flags before its children,
+  // but in QuickTime it doesn't.  Its first child is always hdlr.
+  if metaatom.remaining() >= 8 && string(metaatom.peekn(8)[4:]) != "hdlr" {
+    metaatom.skip(4)
+  }
+  return findatom(metaatom, ilst)
+}
+
+// Reads the header of an atom (a box, in ISO terms), and returns its type
+// and the size of the rest of the atom.  A size of 1 means the real size
+// follows the type, as a 64-bit number, and a size of 0 means the atom runs
+// to the end of the enclosing atom (or the file).
+func nextatom(bb *bytebuffer) (string, int64) {
+  size := int64(bb.read32BE())
+  atomtype := string(bb.read(4))
+  header := int64(8)
+  switch size {
+  case 0:
+    return atomtype, bb.remaining64()
+  case 1:
+    size = int64(bb.read64BE())
+    header = 16
+  }
+  if size < header {
+    failf(ErrCorrupt, "%s atom has size %d", atomtype, size)
+  }
+  return atomtype, size - header
 }
 
+// Returns nil if the atom is not found.
 func findatom(bb *bytebuffer, magic string) *bytebuffer {
   for bb.remaining() > 0 {
-    size := bb.read32BE()
-    atomtype := string(bb.read(4))
+    atomtype, size := nextatom(bb)
     if atomtype == magic {
-      return bytebufferfromparent(bb, size - 8)
+      return bytebufferfromparent64(bb, size)
     }
-    bb.skip(size - 8)
+    bb.skip64(size)
   }
   return nil
 }
@@ -0,0 +1,306 @@
+package tags
+
+import (
+  "math"
+  "strconv"
+)
+
+const trak = "trak"
+const mdia = "mdia"
+const hdlr = "hdlr"
+const minf = "minf"
+const stbl = "stbl"
+const stsd = "stsd"
+
+// The sample rates that an MPEG-4 AudioSpecificConfig can give as an index.
+var aacSampleRates = []int{ 96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350 }
+
+// The AC-3 bitrates, in kbit/s, indexed by the bit_rate_code in dac3.
+var ac3Bitrates = []int{ 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 448, 512, 576, 640 }
+
+// Returns the first trak atom whose handler is "soun", or nil if there
+// isn't one.
+func findaudiotrak(moovatom *bytebuffer) *bytebuffer {
+  moovatom.rewind()
+  for {
+    trakatom := findatom(moovatom, trak)
+    if trakatom == nil {
+      return nil
+    }
+    mdiaatom := findatom(trakatom, mdia)
+    if mdiaatom == nil {
+      continue
+    }
+    // hdlr has four bytes of version and flags and four that are always
+    // zero, and then the handler type.
+    hdlratom := findatom(mdiaatom, hdlr)
+    if hdlratom != nil && hdlratom.remaining() >= 12 && string(hdlratom.read(12)[8:]) == "soun" {
+      trakatom.rewind()
+      return trakatom
+    }
+  }
+}
+
+// Finds the codec and audio properties from the sample description of the
+// audio track, and sets the MIME type and the encoded flags to match.  If
+// there is no audio track, the file is assumed to be AAC.
+func getM4aAudio(moovatom *bytebuffer, m MultiTagMap) {
+  codec := "aac"
+  if trakatom := findaudiotrak(moovatom); trakatom != nil {
+    if stsdatom := findpath(trakatom, mdia, minf, stbl, stsd); stsdatom != nil && stsdatom.remaining() > 8 {
+      stsdatom.skip(8) // version, flags and number of entries
+      entrytype, size := nextatom(stsdatom)
+      codec = getM4aSampleEntry(entrytype, bytebufferfromparent64(stsdatom, size), m)
+    }
+  }
+  m.Set(CodecKey, codec)
+  m.Set(EncodedExtensionKey, "m4a")
+  switch codec {
+  case "aac":
+    setMimeAndExtension("audio/aac", "m4a", m)
+    m.Set(IsEncodedKey, "true")
+  case "alac", "flac":
+    setMimeAndExtension("audio/mp4", "m4a", m)
+    m.Set(IsEncodedKey, "false")
+  default:
+    setMimeAndExtension("audio/mp4", "m4a", m)
+    m.Set(IsEncodedKey, "true")
+  }
+}
+
+// Returns the atom at the end of a path of nested atoms, or nil if any of
+// them is missing.
+func findpath(bb *bytebuffer, path ...string) *bytebuffer {
+  for _, name := range path {
+    if bb = findatom(bb, name); bb == nil {
+      return nil
+    }
+  }
+  return bb
+}
+
+// An audio sample entry has six reserved bytes, a data reference index
+// and eight bytes that QuickTime uses for a version, revision and vendor,
+// followed by the number of channels, the sample size, four more bytes and
+// the sample rate (16.16 fixed point).  Version 1 of the QuickTime layout
+// adds 16 bytes; version 2 adds 36, and replaces the sample rate and number
+// of channels.  Then come atoms that describe the codec.  Returns the name
+// of the codec.
+func getM4aSampleEntry(entrytype string, bb *bytebuffer, m MultiTagMap) string {
+  bb.skip(8)
+  version := bb.read16BE()
+  bb.skip(6)
+  channels := int(bb.read16BE())
+  bitsPerSample := int(bb.read16BE())
+  bb.skip(4)
+  sampleRate := int(bb.read32BE() >> 16)
+  switch version {
+  case 1:
+    bb.skip(16)
+  case 2:
+    bb.skip(4)
+    hi := uint64(bb.read32BE())
+    sampleRate = int(math.Float64frombits(hi << 32 | uint64(bb.read32BE())))
+    channels = int(bb.read32BE())
+    bb.skip(4)
+    bitsPerSample = int(bb.read32BE())
+    bb.skip(12)
+  }
+  m.Set(SampleRateKey, strconv.Itoa(sampleRate))
+  m.Set(ChannelsKey, strconv.Itoa(channels))
+  codec := ""
+  switch entrytype {
+  case "mp4a":
+    codec = "aac"
+    if esds := findatom(bb, "esds"); esds != nil {
+      codec = getM4aEsds(esds, m)
+    }
+  case "alac":
+    codec = "alac"
+    m.Set(BitsPerSampleKey, strconv.Itoa(bitsPerSample))
+    if alac := findatom(bb, "alac"); alac != nil {
+      getM4aAlac(alac, m)
+    }
+  case "ac-3":
+    codec = "ac-3"
+    if dac3 := findatom(bb, "dac3"); dac3 != nil && dac3.remaining() >= 3 {
+      // fscod (2 bits), bsid (5), bsmod (3), acmod (3), lfeon (1) and
+      // bit_rate_code (5)
+      b := dac3.read(3)
+      if code := int((b[1] & 0x03) << 3 | b[2] >> 5); code < len(ac3Bitrates) {
+        m.Set(BitrateKey, strconv.Itoa(ac3Bitrates[code]))
+      }
+    }
+  case "ec-3":
+    codec = "ec-3"
+    if dec3 := findatom(bb, "dec3"); dec3 != nil && dec3.remaining() >= 2 {
+      // data_rate (13 bits, in kbit/s) and the number of streams
+      m.Set(BitrateKey, strconv.Itoa(int(dec3.read16BE() >> 3)))
+    }
+  case "Opus":
+    codec = "opus"
+    if dops := findatom(bb, "dOps"); dops != nil && dops.remaining() >= 8 {
+      // version, channels, pre-skip and the sample rate of the source.  The
+      // audio itself is always at 48kHz.
+      dops.skip(1)
+      m.Set(ChannelsKey, strconv.Itoa(int(dops.readByte())))
+      dops.skip(2)
+      m.Set(SampleRateKey, "48000")
+    }
+  case "fLaC":
+    codec = "flac"
+    if dfla := findatom(bb, "dfLa"); dfla != nil && dfla.remaining() > 8 {
+      // Version and flags, then the FLAC metadata blocks.  The first one is
+      // always the stream info.
+      dfla.skip(4)
+      if blocktype, _, size := nextmetablock(dfla); blocktype == streaminfotype {
+        getFlacStreamInfo(bytebufferfromparent(dfla, size), m)
+      }
+    }
+  default:
+    codec = entrytype
+  }
+  return codec
+}
+
+// The esds atom holds an MPEG-4 ES descriptor, after four bytes of version
+// and flags.  Each descriptor is a tag, a length (seven bits per byte, with
+// the top bit set on all but the last) and its contents.  The ES descriptor
+// contains the decoder config descriptor, which gives the type of the
+// stream and the average bitrate, and which in turn contains the
+// AudioSpecificConfig.  Returns the name of the codec.
+func getM4aEsds(bb *bytebuffer, m MultiTagMap) string {
+  codec := "aac"
+  bb.skip(4)
+  for bb.remaining() >= 2 {
+    tag := bb.readByte()
+    size := esdsLength(bb)
+    switch tag {
+    case 3:
+      // ES ID, then flags that say which optional fields follow.
+      bb.skip(2)
+      flags := bb.readByte()
+      if flags & 0x80 != 0 {
+        bb.skip(2)
+      }
+      if flags & 0x40 != 0 {
+        bb.skip(bb.readByte())
+      }
+      if flags & 0x20 != 0 {
+        bb.skip(2)
+      }
+    case 4:
+      // Object type, stream type and buffer size (four bytes), maximum and
+      // average bitrate.
+      switch bb.readByte() {
+      case 0x69, 0x6b:
+        codec = "mp3"
+      }
+      bb.skip(8)
+      if avg := bb.read32BE(); avg > 0 {
+        m.Set(BitrateKey, strconv.Itoa(int((avg + 500) / 1000)))
+      }
+    case 5:
+      if codec == "aac" {
+        getM4aAudioSpecificConfig(bb.read(size), m)
+      } else {
+        bb.skip(size)
+      }
+    default:
+      bb.skip(size)
+    }
+  }
+  return codec
+}
+
+func esdsLength(bb *bytebuffer) uint32 {
+  var size uint32
+  for j := 0; j < 4; j++ {
+    b := bb.readByte()
+    size = size << 7 | b & 0x7f
+    if b & 0x80 == 0 {
+      break
+    }
+  }
+  return size
+}
+
+// The AudioSpecificConfig starts with the object type (five bits, or
+// eleven if the first five are all set), the sample rate index (four bits,
+// or 28 if the index is 15) and the channel configuration (four bits).
+// HE-AAC adds the extension sample rate index after these.  They take
+// precedence over the sample entry, which can't hold a rate above 65535Hz.
+// Channel configuration 0 means the channels are described elsewhere, and
+// 7 means 7.1.
+func getM4aAudioSpecificConfig(b []byte, m MultiTagMap) {
+  if len(b) < 2 {
+    return
+  }
+  pos := 0
+  take := func(n int) int {
+    v := 0
+    for ; n > 0; n-- {
+      v <<= 1
+      if pos / 8 < len(b) {
+        v |= int(b[pos / 8] >> (7 - pos % 8)) & 1
+      }
+      pos++
+    }
+    return v
+  }
+  rate := func() int {
+    if index := take(4); index == 15 {
+      return take(24)
+    } else if index < len(aacSampleRates) {
+      return aacSampleRates[index]
+    }
+    return 0
+  }
+  objectType := take(5)
+  if objectType == 31 {
+    objectType = 32 + take(6)
+  }
+  sampleRate := rate()
+  channels := take(4)
+  if channels == 7 {
+    channels = 8
+  }
+  // HE-AAC (SBR) and HE-AACv2 (SBR and parametric stereo) signalled
+  // explicitly give the rate of the core AAC stream first, which is half the
+  // rate that's played, and then the extension rate.  Parametric stereo
+  // turns a mono core into stereo.
+  if objectType == 5 || objectType == 29 {
+    if extensionRate := rate(); extensionRate > 0 {
+      sampleRate = extensionRate
+    }
+    if objectType == 29 && channels == 1 {
+      channels = 2
+    }
+  }
+  if sampleRate > 0 {
+    m.Set(SampleRateKey, strconv.Itoa(sampleRate))
+  }
+  if channels > 0 {
+    m.Set(ChannelsKey, strconv.Itoa(channels))
+  }
+}
+
+// The alac atom holds four bytes of version and flags, then the
+// ALACSpecificConfig: the frame length (four bytes), compatible version,
+// bit depth, three tuning parameters, the number of channels (one byte
+// each), the maximum run (two bytes), the maximum frame size, the average
+// bitrate and the sample rate (four bytes each).
+func getM4aAlac(bb *bytebuffer, m MultiTagMap) {
+  if bb.remaining() < 28 {
+    return
+  }
+  bb.skip(9)
+  m.Set(BitsPerSampleKey, strconv.Itoa(int(bb.readByte())))
+  bb.skip(3)
+  m.Set(ChannelsKey, strconv.Itoa(int(bb.readByte())))
+  bb.skip(6)
+  if avg := bb.read32BE(); avg > 0 {
+    m.Set(BitrateKey, strconv.Itoa(int((avg + 500) / 1000)))
+  }
+  m.Set(SampleRateKey, strconv.Itoa(int(bb.read32BE())))
+}
@@ -0,0 +1,27 @@
+package tags
+
+import (
+  "testing"
+)
+
+func TestM4aAudioSpecificConfig(t *testing.T) {
+  tests := []struct {
+    name string
+    b []byte
+    sampleRate, channels string
+  }{
+    // object type 2, 44.1kHz (index 4), stereo
+    { "AAC LC", []byte{ 0x12, 0x10 }, "44100", "2" },
+    // object type 5, 22.05kHz (index 7), stereo, extension 44.1kHz, core type 2
+    { "HE-AAC", []byte{ 0x2b, 0x92, 0x08, 0x00 }, "44100", "2" },
+    // object type 29, 24kHz (index 6), mono, extension 48kHz (index 3), core type 2
+    { "HE-AACv2", []byte{ 0xeb, 0x09, 0x88, 0x00 }, "48000", "2" },
+  }
+  for _, test := range tests {
+    m := make(MultiTagMap)
+    getM4aAudioSpecificConfig(test.b, m)
+    if m.Get(SampleRateKey) != test.sampleRate || m.Get(ChannelsKey) != test.channels {
+      t.Errorf("%s: rate %s, channels %s, want %s and %s", test.name, m.Get(SampleRateKey), m.Get(ChannelsKey), test.sampleRate, test.channels)
+    }
+  }
+}
@@ -1,13 +1,11 @@
 package tags
 
 import (
-  "bytes"
-  "io/ioutil"
-  "log"
+  "io"
+  "strconv"
   "strings"
   "encoding/binary"
-  "golang.org/x/text/transform"
-  "golang.org/x/text/encoding/unicode"
+  "fmt"
 )
 
 // version 1, layer 1 bit rates
@@ -45,8 +43,24 @@ var v2SampleRates = []float64{ 22050.0, 24000.0, 16000.0 }
 var v25SampleRates = []float64{ 11025.0, 12000.0, 8000.0 }
 
 func Mp3TagsFromFile(path string) TagMap {
-  buffer := readFile(path)
-  m := make(TagMap)
+  return logTags(ReadMp3Tags(path))
+}
+
+// ReadMp3Tags is like Mp3TagsFromFile, but returns an error rather than
+// logging it.
+func ReadMp3Tags(path string) (TagMap, error) {
+  return flatten(parseFile(path, readmp3, nil))
+}
+
+// ReadMp3TagsFrom reads the tags from an mp3 file of the given size
+// that is accessed through r.
+func ReadMp3TagsFrom(r io.ReaderAt, size int64) (TagMap, error) {
+  return flatten(parseReader("", r, size, readmp3, nil))
+}
+
+// The file is read through the buffer's window, so memory use doesn't
+// depend on the size of the file.
+func readmp3(bb *bytebuffer, m MultiTagMap, pictures *[]Picture) {
   // Look at each byte.  If the byte is 0xff, check to see if the upper three bits
   // of the next byte are set.  If so, it is the start of a frame.  If not, check
   // to see if the byte is 0x49, which represents the letter 'I'.  If so, check
@@ -55,34 +69,90 @@ func Mp3TagsFromFile(path string) TagMap {
   numFrames := 0
   totalFrameBytes := 0
   duration := 0.0
-  var increment int
-  for n := 0; n < len(buffer); n += increment {
-    increment = 1
-    b := buffer[n]
+  var info *mp3info
+  vbr := false
+  var firstBri uint32
+  for bb.remaining() > 0 {
+    b := bb.peek()
     if b == 0xff {
       // If we don't have at least four bytes, just stop.
-      if n > (len(buffer) - 4) {
+      if bb.remaining() < 4 {
         break
       }
       // Put validation in separate function - need to check for reserved version or layer
-      if validHeader(buffer[n:(n+4)]) {
-        frameSize, frameDuration := mp3ParseFrame(path, buffer[n:], n)
+      header := bb.peekn(4)
+      if validHeader(header) {
+        frameSize, frameDuration := mp3ParseFrame(header)
+        if numFrames == 0 && info == nil {
+          // The first frame may be a Xing, Info or VBRI frame rather than audio.
+          // If it has the frame count, we don't need to visit the other frames.
+          info = mp3ParseInfo(bb.peekn(minInt(frameSize, bb.remaining())))
+          if info != nil {
+            if info.frames > 0 {
+              duration = float64(info.frames) * frameDuration
+              if info.bytes == 0 {
+                info.bytes = uint32(bb.remaining() - frameSize)
+              }
+              break
+            }
+            if frameSize > bb.remaining() {
+              break
+            }
+            bb.skip(uint32(frameSize))
+            continue
+          }
+        }
+        bri := (binary.BigEndian.Uint32(header) >> 12) & 0x0f
+        if numFrames == 0 {
+          firstBri = bri
+        } else if bri != firstBri {
+          vbr = true
+        }
         totalFrameBytes += frameSize
         numFrames++
-        increment = frameSize
         duration = duration + frameDuration
+        // The last frame is often cut short.
+        if frameSize > bb.remaining() {
+          break
+        }
+        bb.skip(uint32(frameSize))
+        continue
       }
-    } else if b == 0x49 {
-      if buffer[n+1] == 0x44 && buffer[n+2] == 0x33 {
-        increment = mp3ParseID3(buffer[n:], m)
+    } else if b == 0x49 && bb.remaining() > 10 {
+      if string(bb.peekn(3)) == "ID3" {
+        readID3(bb, m, pictures)
+        continue
       }
     }
+    bb.skip(1)
+  }
+  if info != nil {
+    vbr = info.vbr
+    if info.frames > 0 {
+      numFrames = int(info.frames)
+      totalFrameBytes = int(info.bytes)
+    }
+    if info.lame != nil {
+      // The delay and padding are silence added by the encoder, so remove them
+      // to get the duration of the original audio.
+      setLameTags(info.lame, m)
+      duration -= float64(info.lame.delay + info.lame.padding) / info.sampleRate
+    }
+  }
+  readID3v1(bb, m)
+  m.Set(FrameCountKey, strconv.Itoa(numFrames))
+  m.Set(StreamBytesKey, strconv.Itoa(totalFrameBytes))
+  if vbr {
+    m.Set(BitrateModeKey, "vbr")
+  } else {
+    m.Set(BitrateModeKey, "cbr")
   }
   setDuration(duration, m)
+  setBitrate(int64(totalFrameBytes), m)
   setMimeAndExtension("audio/mp3", "mp3", m)
-  m[EncodedExtensionKey] = "mp3"
-  m[IsEncodedKey] = "true"
-  return m
+  m.Set(CodecKey, "mp3")
+  m.Set(EncodedExtensionKey, "mp3")
+  m.Set(IsEncodedKey, "true")
 }
 
 func validHeader(b []byte) bool {
@@ -118,34 +188,200 @@ func validHeader(b []byte) bool {
 // These pages were helpful too:
 // https://web.archive.org/web/20070821052201/https://www.id3.org/mp3Frame
 // https://stackoverflow.com/questions/6220660/calculating-the-length-of-mp3-frames-in-milliseconds
-func mp3ParseFrame(path string, buffer []byte, offset int) (int, float64) {
+//
+// The frame size works out to slots * bitRate / sampleRate, where a slot is
+// four bytes for layer I and one byte for layers II and III.  The samples
+// per frame (and so the number of slots) depend on the version and layer:
+//
+//   layer I              384 samples, 12 slots of 4 bytes
+//   layer II             1152 samples, 144 slots
+//   layer III, MPEG 1    1152 samples, 144 slots
+//   layer III, MPEG 2/2.5  576 samples, 72 slots
+//
+// Padding adds one slot.  The CRC (if present) is already part of the frame size.
+func mp3ParseFrame(buffer []byte) (int, float64) {
   // Convert the first four bytes into a big-endian uint32.
   header := binary.BigEndian.Uint32(buffer[0:4])
   versionIndex := (header >> 19) & 0x03
   layerIndex := (header >> 17) & 0x03
-  // We only handle MP3 at this time.
-  if versionIndex != 3 || layerIndex != 1 {
-    // log.Fatalf("Got frame with version %d and layer %d at offset %d\n", version, layer, offset)
-  }
-  protection := (header & 0x010000) == 0
   bri := (header >> 12) & 0x0f  // bit rate index
   sri := (header >> 10) & 0x03  // sample rate index
   padding := (header >> 9) & 0x01 == 0x01
   // We now have enough info to calculate the size of the frame.
-  bitRate, sampleRate := getBitAndSampleRates(path, versionIndex, layerIndex, bri, sri)
-  frameSize := int((144.0 * bitRate) / sampleRate)
+  bitRate, sampleRate := getBitAndSampleRates(versionIndex, layerIndex, bri, sri)
+  samples := mp3SamplesPerFrame(versionIndex, layerIndex)
+  if layerIndex == 3 {
+    frameSize := int((12.0 * bitRate) / sampleRate)
+    if padding {
+      frameSize += 1
+    }
+    return frameSize * 4, samples / sampleRate
+  }
+  frameSize := int((samples / 8.0 * bitRate) / sampleRate)
   if padding {
     frameSize += 1
   }
-  if protection {
-    frameSize += 2
+  return frameSize, samples / sampleRate
+}
+
+// Note that versionIndex and layerIndex are "raw", as described for getBitAndSampleRates.
+func mp3SamplesPerFrame(versionIndex, layerIndex uint32) float64 {
+  if layerIndex == 3 {
+    return 384.0
+  }
+  if layerIndex == 1 && versionIndex != 3 {
+    return 576.0
+  }
+  return 1152.0
+}
+
+// Information from the Xing, Info or VBRI header that encoders put in the
+// first frame.  A count of zero means the header didn't include it.
+type mp3info struct {
+  frames uint32
+  bytes uint32
+  vbr bool
+  sampleRate float64
+  lame *lameinfo
+}
+
+// The LAME extension that follows the Xing or Info header.
+type lameinfo struct {
+  encoder string
+  lowpass int // in Hz
+  peak float64 // zero if not set
+  trackGain string // empty if not set
+  albumGain string
+  delay int
+  padding int
+}
+
+// Looks for a Xing or Info header, which follows the side information in
+// the frame, or a VBRI header, which is always 32 bytes after the frame
+// header.  Returns nil if neither is present.  The layouts are described here:
+// https://www.codeproject.com/Articles/8295/MPEG-Audio-Frame-Header#XINGHeader
+// https://www.codeproject.com/Articles/8295/MPEG-Audio-Frame-Header#VBRIHeader
+func mp3ParseInfo(frame []byte) *mp3info {
+  header := binary.BigEndian.Uint32(frame[0:4])
+  versionIndex := (header >> 19) & 0x03
+  mono := (header >> 6) & 0x03 == 0x03
+  offset := 4
+  if versionIndex == 3 {
+    if mono {
+      offset += 17
+    } else {
+      offset += 32
+    }
+  } else {
+    if mono {
+      offset += 9
+    } else {
+      offset += 17
+    }
+  }
+  if (header & 0x010000) == 0 {
+    offset += 2 // CRC
+  }
+  if len(frame) >= offset + 8 {
+    tag := string(frame[offset:offset+4])
+    if tag == "Xing" || tag == "Info" {
+      info := new(mp3info)
+      info.vbr = tag == "Xing"
+      bb := bytebufferfromslice(frame[offset+4:])
+      flags := bb.read32BE()
+      if flags & 0x01 != 0 && bb.remaining() >= 4 {
+        info.frames = bb.read32BE()
+      }
+      if flags & 0x02 != 0 && bb.remaining() >= 4 {
+        info.bytes = bb.read32BE()
+      }
+      if flags & 0x04 != 0 && bb.remaining() >= 100 {
+        bb.skip(100) // table of contents
+      }
+      if flags & 0x08 != 0 && bb.remaining() >= 4 {
+        bb.skip(4) // quality
+      }
+      if bb.remaining() >= 36 {
+        info.lame = mp3ParseLame(bb)
+      }
+      bri := (header >> 12) & 0x0f
+      sri := (header >> 10) & 0x03
+      _, info.sampleRate = getBitAndSampleRates(versionIndex, (header >> 17) & 0x03, bri, sri)
+      return info
+    }
+  }
+  if len(frame) >= 36 + 18 && string(frame[36:40]) == "VBRI" {
+    // Skip the version, delay and quality.
+    bb := bytebufferfromslice(frame[46:])
+    info := new(mp3info)
+    info.vbr = true
+    info.bytes = bb.read32BE()
+    info.frames = bb.read32BE()
+    return info
+  }
+  return nil
+}
+
+// The LAME tag is described here:
+// http://gabriel.mp3-tech.org/mp3infotag.html
+// Returns nil if the encoder string doesn't look like one.
+func mp3ParseLame(bb *bytebuffer) *lameinfo {
+  encoder := bb.read(9)
+  for _, c := range encoder[0:4] {
+    if c < 0x20 || c > 0x7e {
+      return nil
+    }
+  }
+  lame := new(lameinfo)
+  lame.encoder = strings.TrimRight(string(encoder), " \000")
+  bb.skip(1) // revision and VBR method
+  lame.lowpass = int(bb.readByte()) * 100
+  // The peak is a fixed point number with 23 bits of fraction.
+  lame.peak = float64(bb.read32BE()) / float64(1 << 23)
+  lame.trackGain = lameReplayGain(bb.read16BE(), 1)
+  lame.albumGain = lameReplayGain(bb.read16BE(), 2)
+  bb.skip(2) // encoding flags, ATH type and bitrate
+  delayAndPadding := uint32(bb.readByte()) << 16 | uint32(bb.read16BE())
+  lame.delay = int(delayAndPadding >> 12)
+  lame.padding = int(delayAndPadding & 0x0fff)
+  return lame
+}
+
+// The top three bits of a replay gain field are the name code, which is 1 for
+// track (radio) gain and 2 for album (audiophile) gain.  Bit 9 is the sign and
+// the low nine bits are the gain in tenths of a dB.
+func lameReplayGain(field uint16, name uint16) string {
+  if field >> 13 != name {
+    return ""
+  }
+  gain := float64(field & 0x01ff) / 10.0
+  if field & 0x0200 != 0 {
+    gain = -gain
+  }
+  return fmt.Sprintf("%.2f dB", gain)
+}
+
+func setLameTags(lame *lameinfo, m MultiTagMap) {
+  m.Set(EncoderKey, lame.encoder)
+  m.Set(EncoderDelayKey, strconv.Itoa(lame.delay))
+  m.Set(EncoderPaddingKey, strconv.Itoa(lame.padding))
+  if lame.lowpass > 0 {
+    m.Set(LowpassKey, strconv.Itoa(lame.lowpass))
+  }
+  if lame.peak > 0 {
+    m.Set(ReplayGainTrackPeakKey, fmt.Sprintf("%.6f", lame.peak))
+  }
+  if lame.trackGain != "" {
+    m.Set(ReplayGainTrackGainKey, lame.trackGain)
+  }
+  if lame.albumGain != "" {
+    m.Set(ReplayGainAlbumGainKey, lame.albumGain)
   }
-  return frameSize, 1152.0 / sampleRate
 }
 
 // Note that versionIndex and layerIndex are "raw" - i.e., directly from the frame.
 // e.g. versionIndex == 3 means MPEG version 1 and layerIndex == 1 means layer III
-func getBitAndSampleRates(path string, versionIndex, layerIndex, bri, sri uint32) (float64, float64) {
+func getBitAndSampleRates(versionIndex, layerIndex, bri, sri uint32) (float64, float64) {
   // Version index == 3 => MPEG version 1
   if versionIndex == 3 {
     if layerIndex == 1 {
@@ -173,71 +409,6 @@ func getBitAndSampleRates(path string, versionIndex, layerIndex, bri, sri uint32
     }
   }
   // Don't handle anything else at this point.
-  log.Fatalf("Unable to determine bit rate for %s from versionIndex %d and layerIndex %d\n", path, versionIndex, layerIndex)
+  failf(ErrCorrupt, "unable to determine bit rate from versionIndex %d and layerIndex %d", versionIndex, layerIndex)
   return 0.0, 0.0 // should never reach this
 }
-
-// MP3 ID3 blocks are described here:
-// https://id3.org/id3v2.3.0
-// The encodings are listed here:
-// https://stackoverflow.com/questions/9857727/text-encoding-in-id3v2-3-tags
-func mp3ParseID3(buffer []byte, m TagMap) int {
-  headerSize := 10
-  // Check for extended header
-  if buffer[5] & 0x40 == 0x40 {
-    headerSize += 4 + int(buffer[13])
-  }
-  // Get the size of the tag frame.
-  frameSize := mp3GetID3Size(buffer[6:])
-  // Start after the header, and read tags until we're through.
-  // For now, let's just get the size.
-  eob := headerSize + frameSize // eob means end of buffer
-  for j := headerSize; j < eob; {
-    // Skip zero bytes between tags.  Note: if we find a zero byte, we're probably at the end of the tags.
-    if buffer[j] == 0 {
-      j++
-      continue
-    }
-    key := string(buffer[j:j+4])
-    size := int(binary.BigEndian.Uint32(buffer[j+4:j+8]))
-    if strings.HasPrefix(key, "T") {
-      // Ignore encoding for now.
-      encoding := buffer[j+10]
-      var value string
-      // 0 is ASCII, 3 is UTF-8
-      if encoding == 0 || encoding == 3 {
-        value = string(buffer[j+11:j+size+10])
-      } else if encoding == 1 {
-        // String is UTF-16, with BOM
-        value = stringFromUTF16(buffer[j+11:j+size+10])
-      }
-      // Some tags have a zero byte at the end to make the string an even length.
-      // We need to remove it.
-      m[key] = strings.TrimSuffix(value, "\000")
-    }
-    j += size + 10
-  }
-  return eob
-}
-
-// TASK: move this to btu
-func stringFromUTF16(b []byte) string {
-  bomEncoder := unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
-  bomReader := transform.NewReader(bytes.NewReader(b), bomEncoder.NewDecoder())
-  decoded, err := ioutil.ReadAll(bomReader)
-  if err != nil {
-    log.Fatalf("Unable to get a string from UTF16\n")
-  }
-  s := string(decoded)
-  return s
-}
-
-func mp3GetID3Size(b []byte) int {
-  // Read four bytes, use the lower 7 bits of each one to form a 28-bit size.
-  var total int = 0
-  for j := 0; j < 4; j++ {
-    total <<= 7
-    total += int(b[j]) & 0x7f
-  }
-  return total
-}
@@ -0,0 +1,67 @@
+package tags
+
+import (
+  "encoding/binary"
+  "math"
+  "testing"
+)
+
+// Builds a frame header with the first sample rate of the version.
+func testMp3Header(versionIndex, layerIndex, bri uint32, padding bool) []byte {
+  return testMp3HeaderRate(versionIndex, layerIndex, bri, 0, padding)
+}
+
+// Builds a frame header with the given sample rate index.
+func testMp3HeaderRate(versionIndex, layerIndex, bri, sri uint32, padding bool) []byte {
+  header := uint32(0xffe00000) | versionIndex << 19 | layerIndex << 17 | 1 << 16 | bri << 12 | sri << 10
+  if padding {
+    header |= 1 << 9
+  }
+  b := make([]byte, 4)
+  binary.BigEndian.PutUint32(b, header)
+  return b
+}
+
+func TestMp3ParseFrame(t *testing.T) {
+  tests := []struct {
+    name string
+    versionIndex, layerIndex, bri, sri uint32
+    size, paddedSize int
+    samples float64
+    sampleRate float64
+  }{
+    { "MPEG-1 Layer I 128k", 3, 3, 4, 0, 136, 140, 384, 44100 },
+    { "MPEG-1 Layer II 128k", 3, 2, 8, 0, 417, 418, 1152, 44100 },
+    { "MPEG-1 Layer III 128k", 3, 1, 9, 0, 417, 418, 1152, 44100 },
+    { "MPEG-2 Layer I 64k", 2, 3, 4, 0, 136, 140, 384, 22050 },
+    { "MPEG-2 Layer II 64k", 2, 2, 8, 0, 417, 418, 1152, 22050 },
+    { "MPEG-2 Layer III 64k", 2, 1, 8, 0, 208, 209, 576, 22050 },
+    { "MPEG-2.5 Layer I 64k", 0, 3, 4, 0, 276, 280, 384, 11025 },
+    { "MPEG-2.5 Layer II 64k", 0, 2, 8, 0, 835, 836, 1152, 11025 },
+    { "MPEG-2.5 Layer III 64k", 0, 1, 8, 0, 417, 418, 576, 11025 },
+    { "MPEG-1 Layer I 128k 32kHz", 3, 3, 4, 2, 192, 196, 384, 32000 },
+    { "MPEG-1 Layer III 128k 48kHz", 3, 1, 9, 1, 384, 385, 1152, 48000 },
+    { "MPEG-2 Layer II 64k 16kHz", 2, 2, 8, 2, 576, 577, 1152, 16000 },
+    { "MPEG-2 Layer III 64k 24kHz", 2, 1, 8, 1, 192, 193, 576, 24000 },
+    { "MPEG-2.5 Layer I 64k 8kHz", 0, 3, 4, 2, 384, 388, 384, 8000 },
+    { "MPEG-2.5 Layer III 64k 12kHz", 0, 1, 8, 1, 384, 385, 576, 12000 },
+  }
+  for _, test := range tests {
+    if samples := mp3SamplesPerFrame(test.versionIndex, test.layerIndex); samples != test.samples {
+      t.Errorf("%s: %v samples per frame, want %v", test.name, samples, test.samples)
+    }
+    for _, padding := range []bool{ false, true } {
+      want := test.size
+      if padding {
+        want = test.paddedSize
+      }
+      size, duration := mp3ParseFrame(testMp3HeaderRate(test.versionIndex, test.layerIndex, test.bri, test.sri, padding))
+      if size != want {
+        t.Errorf("%s (padding %v): frame size %d, want %d", test.name, padding, size, want)
+      }
+      if math.Abs(duration - test.samples / test.sampleRate) > 1e-9 {
+        t.Errorf("%s (padding %v): frame duration %v, want %v", test.name, padding, duration, test.samples / test.sampleRate)
+      }
+    }
+  }
+}
@@ -0,0 +1,101 @@
+package tags
+
+import (
+  "io"
+  "io/fs"
+  "strings"
+)
+
+// A MultiTagMap holds every value of each tag, in the order they appear in
+// the file.  Vorbis comments, ID3v2.4 text frames and m4a items can all hold
+// more than one value (several artists, for example); a TagMap joins them
+// with MultiValueSeparator.
+type MultiTagMap map[string][]string
+
+// Get returns the first value of key, or the empty string if there isn't one.
+func (m MultiTagMap) Get(key string) string {
+  if values := m[key]; len(values) > 0 {
+    return values[0]
+  }
+  return ""
+}
+
+// GetAll returns all the values of key.
+func (m MultiTagMap) GetAll(key string) []string {
+  return m[key]
+}
+
+// Set replaces any values of key with value.
+func (m MultiTagMap) Set(key, value string) {
+  m[key] = []string{value}
+}
+
+// Add appends value to the values of key.
+func (m MultiTagMap) Add(key, value string) {
+  m[key] = append(m[key], value)
+}
+
+// Flatten returns a TagMap with the values of each key joined with
+// MultiValueSeparator.  This is what the functions that return a TagMap do.
+func (m MultiTagMap) Flatten() TagMap {
+  tagMap := make(TagMap, len(m))
+  for k, v := range m {
+    tagMap[k] = strings.Join(v, MultiValueSeparator)
+  }
+  return tagMap
+}
+
+// ReadMultiTags is like ReadTags, but keeps each value of a tag separate.
+func ReadMultiTags(path string) (MultiTagMap, error) {
+  return parseFile(path, readany, nil)
+}
+
+// ReadMultiTagsFrom is like ReadMultiTags, but reads from r as described
+// for ReadTagsFrom.
+func ReadMultiTagsFrom(r io.ReaderAt, size int64) (MultiTagMap, error) {
+  return parseReader("", r, size, readany, nil)
+}
+
+// ReadMultiTagsFS is like ReadMultiTags, but reads the file at path within
+// fsys as described for ReadTagsFS.
+func ReadMultiTagsFS(fsys fs.FS, path string) (MultiTagMap, error) {
+  m, err := readFS(fsys, path, nil)
+  if m != nil {
+    setPaths(path, m)
+  }
+  return m, err
+}
+
+// ReadStandardMultiTags is like ReadStandardTags, but keeps each value of a
+// tag separate.
+func ReadStandardMultiTags(path string) (MultiTagMap, error) {
+  return translated(ReadMultiTags(path))
+}
+
+// ReadStandardMultiTagsFrom is like ReadStandardMultiTags, but reads from r
+// as described for ReadTagsFrom.
+func ReadStandardMultiTagsFrom(r io.ReaderAt, size int64) (MultiTagMap, error) {
+  return translated(ReadMultiTagsFrom(r, size))
+}
+
+// ReadStandardMultiTagsFS is like ReadStandardMultiTags, but reads the file
+// at path within fsys as described for ReadTagsFS.
+func ReadStandardMultiTagsFS(fsys fs.FS, path string) (MultiTagMap, error) {
+  return translated(ReadMultiTagsFS(fsys, path))
+}
+
+func translated(m MultiTagMap, err error) (MultiTagMap, error) {
+  if len(m) > 0 {
+    translateMultiKeys(m)
+  }
+  return m, err
+}
+
+// Turns the result of one of the multi-valued functions into the result of
+// the matching TagMap function.
+func flatten(m MultiTagMap, err error) (TagMap, error) {
+  if m == nil {
+    return nil, err
+  }
+  return m.Flatten(), err
+}
@@ -0,0 +1,118 @@
+package tags
+
+import (
+  "bytes"
+  "image"
+  "image/color"
+  _ "image/gif"
+  _ "image/jpeg"
+  _ "image/png"
+  "io"
+  "io/fs"
+  "strconv"
+  "strings"
+)
+
+// Picture types, as used by ID3v2 APIC frames and FLAC PICTURE blocks.
+// There are others (such as 5 for a leaflet page); these are the common ones.
+const OtherPicture = 0
+const FileIconPicture = 1
+const FrontCoverPicture = 3
+const BackCoverPicture = 4
+
+// Picture is an image embedded in a music file.  Width, Height and Depth
+// (bits per pixel) come from the FLAC PICTURE block when there is one, and
+// otherwise from the image itself; they are zero if the image format isn't
+// recognized.
+type Picture struct {
+  MimeType string
+  Type int
+  Description string
+  Width int
+  Height int
+  Depth int
+  Data []byte
+}
+
+// ReadPictures returns the images embedded in a flac, mp3 or m4a file:
+// FLAC PICTURE blocks, ID3v2 APIC (and v2.2 PIC) frames and the covr atom
+// of an m4a file.  If all you need is to know whether a file has artwork,
+// the tags read by ReadTags are cheaper: HasArtworkKey and ArtworkSizeKey
+// are set from the first picture without reading its data.
+func ReadPictures(path string) ([]Picture, error) {
+  pictures := make([]Picture, 0)
+  _, err := parseFile(path, readany, &pictures)
+  return pictures, err
+}
+
+// ReadPicturesFrom is like ReadPictures, but reads a file of the given size
+// that is accessed through r.
+func ReadPicturesFrom(r io.ReaderAt, size int64) ([]Picture, error) {
+  pictures := make([]Picture, 0)
+  _, err := parseReader("", r, size, readany, &pictures)
+  return pictures, err
+}
+
+// ReadPicturesFS is like ReadPictures, but reads the file at path within fsys.
+func ReadPicturesFS(fsys fs.FS, path string) ([]Picture, error) {
+  pictures := make([]Picture, 0)
+  _, err := readFS(fsys, path, &pictures)
+  return pictures, err
+}
+
+// Records a picture found by one of the parsers.  The artwork tags describe
+// the first picture; size is the size of its data, which may not have been
+// read.  The picture itself is only kept if pictures is not nil.
+func addPicture(pic Picture, size int, m MultiTagMap, pictures *[]Picture) {
+  if _, present := m[HasArtworkKey]; !present {
+    m.Set(HasArtworkKey, "true")
+    m.Set(ArtworkSizeKey, strconv.Itoa(size))
+  }
+  if pictures == nil {
+    return
+  }
+  if pic.Width == 0 || pic.Height == 0 {
+    if config, format, err := image.DecodeConfig(bytes.NewReader(pic.Data)); err == nil {
+      pic.Width = config.Width
+      pic.Height = config.Height
+      pic.Depth = colorDepth(config.ColorModel)
+      if pic.MimeType == "" {
+        pic.MimeType = "image/" + format
+      }
+    }
+  }
+  *pictures = append(*pictures, pic)
+}
+
+// Some taggers write a bare format ("JPG", or "jpg" instead of "jpeg")
+// rather than a MIME type.  An empty result is filled in by addPicture.
+func imageMimeType(s string) string {
+  s = strings.ToLower(s)
+  if s == "" || strings.Contains(s, "/") {
+    return strings.Replace(s, "/jpg", "/jpeg", 1)
+  }
+  if s == "jpg" {
+    s = "jpeg"
+  }
+  return "image/" + s
+}
+
+// Returns the bits per pixel of an image with the given color model.
+func colorDepth(model color.Model) int {
+  switch model {
+  case color.GrayModel, color.AlphaModel:
+    return 8
+  case color.Gray16Model, color.Alpha16Model:
+    return 16
+  case color.YCbCrModel:
+    return 24
+  case color.RGBAModel, color.NRGBAModel, color.CMYKModel:
+    return 32
+  case color.RGBA64Model, color.NRGBA64Model:
+    return 64
+  }
+  if _, paletted := model.(color.Palette); paletted {
+    return 8
+  }
+  return 0
+}
@@ -1,7 +1,11 @@
 package tags
 
 import (
+  "errors"
+  "io"
   "log"
+  "os"
+  "sort"
   "strings"
 )
 
@@ -11,68 +15,322 @@ var keyTranslations = map[string]string {
   "\xa9alb" : AlbumKey,
   "soar" : ArtistSortKey,
   "soal" : AlbumSortKey,
+  "aART" : AlbumArtistKey,
+  "\xa9wrt" : ComposerKey,
+  "\xa9gen" : GenreKey,
+  "gnre" : GenreKey,
+  "\xa9cmt" : CommentKey,
+  "\xa9lyr" : LyricsKey,
+  "\xa9grp" : GroupingKey,
+  "tmpo" : BpmKey,
+  "cpil" : CompilationKey,
+  "pgap" : GaplessKey,
+  "sonm" : TitleSortKey,
+  "soaa" : AlbumArtistSortKey,
+  "soco" : ComposerSortKey,
+  "rtng" : RatingKey,
+  "cprt" : CopyrightKey,
+  "\xa9too" : EncoderKey,
+  "desc" : DescriptionKey,
+  "ldes" : LongDescriptionKey,
+  "ALBUMARTIST" : AlbumArtistKey,
+  "TPE2" : AlbumArtistKey,
+  "TP2" : AlbumArtistKey,
+  "COMPOSER" : ComposerKey,
+  "TCOM" : ComposerKey,
+  "TCM" : ComposerKey,
+  "GENRE" : GenreKey,
+  "TCON" : GenreKey,
+  "TCO" : GenreKey,
   "ALBUM" : AlbumKey,
   "ARTIST" : ArtistKey,
   "TITLE" : TitleKey,
   "trkn" : TrackNumberKey,
   "disk" : DiscNumberKey,
-  "tracknumber" : TrackNumberKey,
   "TRACKNUMBER" : TrackNumberKey,
   "DISCNUMBER" : DiscNumberKey,
   "TIT2" : TitleKey,
   "TPE1" : ArtistKey,
   "TALB" : AlbumKey,
+  "DATE" : DateKey,
+  "TDRC" : DateKey,
+  "TYER" : DateKey,
+  "TYE" : DateKey,
+  "\xa9day" : DateKey,
+  "TT2" : TitleKey,
+  "TP1" : ArtistKey,
+  "TAL" : AlbumKey,
+  "TRK" : TrackNumberKey,
+  "TPA" : DiscNumberKey,
+  "COMMENT" : CommentKey,
+  "LYRICS" : LyricsKey,
+  "MUSICBRAINZ_TRACKID" : MusicBrainzTrackIdKey,
+  "MUSICBRAINZ_ALBUMID" : MusicBrainzAlbumIdKey,
+  "MUSICBRAINZ_ARTISTID" : MusicBrainzArtistIdKey,
+  "MUSICBRAINZ_ALBUMARTISTID" : MusicBrainzAlbumArtistIdKey,
+  "MUSICBRAINZ_RELEASEGROUPID" : MusicBrainzReleaseGroupIdKey,
+  "MUSICBRAINZ_RELEASETRACKID" : MusicBrainzReleaseTrackIdKey,
+  "UFID:http://musicbrainz.org" : MusicBrainzTrackIdKey,
+  "TXXX:MusicBrainz Album Id" : MusicBrainzAlbumIdKey,
+  "TXXX:MusicBrainz Artist Id" : MusicBrainzArtistIdKey,
+  "TXXX:MusicBrainz Album Artist Id" : MusicBrainzAlbumArtistIdKey,
+  "TXXX:MusicBrainz Release Group Id" : MusicBrainzReleaseGroupIdKey,
+  "TXXX:MusicBrainz Release Track Id" : MusicBrainzReleaseTrackIdKey,
+  "REPLAYGAIN_TRACK_GAIN" : ReplayGainTrackGainKey,
+  "REPLAYGAIN_TRACK_PEAK" : ReplayGainTrackPeakKey,
+  "REPLAYGAIN_ALBUM_GAIN" : ReplayGainAlbumGainKey,
+  "REPLAYGAIN_ALBUM_PEAK" : ReplayGainAlbumPeakKey,
+  "TXXX:REPLAYGAIN_TRACK_GAIN" : ReplayGainTrackGainKey,
+  "TXXX:REPLAYGAIN_TRACK_PEAK" : ReplayGainTrackPeakKey,
+  "TXXX:REPLAYGAIN_ALBUM_GAIN" : ReplayGainAlbumGainKey,
+  "TXXX:REPLAYGAIN_ALBUM_PEAK" : ReplayGainAlbumPeakKey,
+  "TXXX:replaygain_track_gain" : ReplayGainTrackGainKey,
+  "TXXX:replaygain_track_peak" : ReplayGainTrackPeakKey,
+  "TXXX:replaygain_album_gain" : ReplayGainAlbumGainKey,
+  "TXXX:replaygain_album_peak" : ReplayGainAlbumPeakKey,
+  "ISRC" : IsrcKey,
+  "TSRC" : IsrcKey,
+  "com.apple.iTunes:ISRC" : IsrcKey,
+  "com.apple.iTunes:MusicBrainz Track Id" : MusicBrainzTrackIdKey,
+  "com.apple.iTunes:MusicBrainz Album Id" : MusicBrainzAlbumIdKey,
+  "com.apple.iTunes:MusicBrainz Artist Id" : MusicBrainzArtistIdKey,
+  "com.apple.iTunes:MusicBrainz Album Artist Id" : MusicBrainzAlbumArtistIdKey,
+  "com.apple.iTunes:MusicBrainz Release Group Id" : MusicBrainzReleaseGroupIdKey,
+  "com.apple.iTunes:MusicBrainz Release Track Id" : MusicBrainzReleaseTrackIdKey,
+  "com.apple.iTunes:REPLAYGAIN_TRACK_GAIN" : ReplayGainTrackGainKey,
+  "com.apple.iTunes:REPLAYGAIN_TRACK_PEAK" : ReplayGainTrackPeakKey,
+  "com.apple.iTunes:REPLAYGAIN_ALBUM_GAIN" : ReplayGainAlbumGainKey,
+  "com.apple.iTunes:REPLAYGAIN_ALBUM_PEAK" : ReplayGainAlbumPeakKey,
+  "com.apple.iTunes:replaygain_track_gain" : ReplayGainTrackGainKey,
+  "com.apple.iTunes:replaygain_track_peak" : ReplayGainTrackPeakKey,
+  "com.apple.iTunes:replaygain_album_gain" : ReplayGainAlbumGainKey,
+  "com.apple.iTunes:replaygain_album_peak" : ReplayGainAlbumPeakKey,
 }
 
+// When several keys in a file translate to the same standard key, the one
+// that comes first here wins; the others are tried in order of name.
+// gnre can only hold one of the ID3v1 genres, so \xa9gen comes before it.
+var keyPriority = []string{ "DATE", "\xa9day", "TDRC", "TYER", "TYE", "GENRE", "\xa9gen", "gnre", "TCON", "TCO" }
+
 func GetTagsFromFile(path string) TagMap {
-  if strings.HasSuffix(path, "flac") {
-    return FlacTagsFromFile(path)
-  } else if strings.HasSuffix(path, "mp3") {
-    return Mp3TagsFromFile(path)
-  } else if strings.HasSuffix(path, "m4a") {
-    return M4aTagsFromFile(path)
+  tagMap, err := ReadTags(path)
+  if errors.Is(err, ErrUnsupportedFormat) {
+    return make(TagMap)
   }
-  return make(TagMap)
+  return logTags(tagMap, err)
 }
 
 func GetStandardTagsFromFile(path string) TagMap {
-  tagMap := GetTagsFromFile(path)
-  if tagMap == nil || len(tagMap) == 0 {
-    return tagMap
+  m, err := ReadStandardMultiTags(path)
+  if errors.Is(err, ErrUnsupportedFormat) {
+    return make(TagMap)
+  }
+  tagMap := logTags(flatten(m, err))
+  // Only the functions that predate the Read functions log.
+  if _, present := tagMap[TrackNumberKey]; !present && len(tagMap) > 0 {
+    log.Printf("Can't get track number for '%s'\n", tagMap[RelativePathKey])
+  }
+  return tagMap
+}
+
+// ReadTags is like GetTagsFromFile, but reports problems with the file as
+// an error instead of logging them or panicking.  The error is a *TagError
+// wrapping ErrUnsupportedFormat, ErrTruncated, ErrCorrupt or the error from
+// the file system.  When an error occurs part way through a file, the tags
+// read up to that point are returned along with the error.
+//
+// The format is determined from the content of the file (see DetectFormat),
+// not from its name.
+func ReadTags(path string) (TagMap, error) {
+  return flatten(ReadMultiTags(path))
+}
+
+// ReadTagsFrom is like ReadTags, but reads a file of the given size that is
+// accessed through r.  This works with anything that implements io.ReaderAt,
+// such as an *os.File, a *bytes.Reader or an io.SectionReader.
+func ReadTagsFrom(r io.ReaderAt, size int64) (TagMap, error) {
+  return flatten(ReadMultiTagsFrom(r, size))
+}
+
+// ReadStandardTags is like GetStandardTagsFromFile, but returns an error
+// as described for ReadTags.
+func ReadStandardTags(path string) (TagMap, error) {
+  return flatten(ReadStandardMultiTags(path))
+}
+
+// ReadStandardTagsFrom is like ReadStandardTags, but reads from r as
+// described for ReadTagsFrom.
+func ReadStandardTagsFrom(r io.ReaderAt, size int64) (TagMap, error) {
+  return flatten(ReadStandardMultiTagsFrom(r, size))
+}
+
+// A parser reads the tags from a buffer that holds a whole file.  If the
+// pointer to the slice of pictures is not nil, it also collects the pictures.
+type parser func(*bytebuffer, MultiTagMap, *[]Picture)
+
+func parseFile(path string, parse parser, pictures *[]Picture) (MultiTagMap, error) {
+  f, err := os.Open(path)
+  if err != nil {
+    return nil, &TagError{path, err}
+  }
+  defer f.Close()
+  info, err := f.Stat()
+  if err != nil {
+    return nil, &TagError{path, err}
+  }
+  return parseReader(path, f, info.Size(), parse, pictures)
+}
+
+// Path is only used to describe errors, and may be empty.
+func parseReader(path string, r io.ReaderAt, size int64, parse parser, pictures *[]Picture) (m MultiTagMap, err error) {
+  defer catch(path, &err)
+  m = make(MultiTagMap)
+  parse(bytebufferfromreader(r, size), m, pictures)
+  return m, nil
+}
+
+// readany chooses the parser based on the content of the file.
+func readany(bb *bytebuffer, m MultiTagMap, pictures *[]Picture) {
+  format, err := DetectFormat(bb.r)
+  if err != nil {
+    fail(err)
+  }
+  switch format {
+  case FlacFormat:
+    readflac(bb, m, pictures)
+  case Mp3Format:
+    readmp3(bb, m, pictures)
+  case M4aFormat:
+    readm4a(bb, m, pictures)
+  default:
+    fail(ErrUnsupportedFormat)
+  }
+}
+
+// The functions that predate the Read functions log problems and return
+// whatever tags were found.
+func logTags(tagMap TagMap, err error) TagMap {
+  if err != nil {
+    log.Printf("%s\n", err.Error())
+  }
+  if tagMap == nil {
+    tagMap = make(TagMap)
   }
-  translateKeys(tagMap)
   return tagMap
 }
 
 // Replace keys with standard names.
-func translateKeys(song TagMap) {
-  for k, v := range song {
-    if trans, present := keyTranslations[k]; present {
-      delete(song, k)
-      song[trans] = v
+func translateMultiKeys(song MultiTagMap) {
+  // ID3v2 genres may refer to the ID3v1 list by number.
+  for _, k := range []string{ "TCON", "TCO" } {
+    for j, v := range song[k] {
+      song[k][j] = id3Genre(v)
+    }
+  }
+  // A translated value replaces any value already under the standard key,
+  // but not one translated from another key.
+  done := make(map[string]bool)
+  for _, k := range translationOrder(song) {
+    trans, _ := keyTranslation(k)
+    switch {
+    case !done[trans]:
+      song[trans] = song[k]
+      done[trans] = true
+    case trans == CommentKey || trans == LyricsKey:
+      // Comments and lyrics in several languages are all kept.
+      song[trans] = append(song[trans], song[k]...)
     }
+    delete(song, k)
   }
   // Check for the track number.  If it exists, clean it up.  If not, see if
   // the TRCK tag exists, which is track number / track total and get the track number from that.
-  if v, present := song[TrackNumberKey]; present {
-      song[TrackNumberKey] = cleanUpNumber(v)
-    } else {
-      if tntt, tnttPresent := song["TRCK"]; tnttPresent {
-        song[TrackNumberKey] = cleanUpNumber(tntt)
-      } else {
-      log.Printf("Can't get track number for '%s'\n", song[RelativePathKey])
-    }
+  // Either way, keep the total if there is one.
+  var tntt, dndt string
+  if _, present := song[TrackNumberKey]; present {
+    tntt = song.Get(TrackNumberKey)
+    song.Set(TrackNumberKey, cleanUpNumber(tntt))
+  } else if _, tnttPresent := song["TRCK"]; tnttPresent {
+    tntt = song.Get("TRCK")
+    song.Set(TrackNumberKey, cleanUpNumber(tntt))
   }
+  setTotal(song, TrackTotalKey, tntt, "TRACKTOTAL", "TOTALTRACKS")
   // Check for the disc number.  If it exists, clean it up.  If not, see if it has the
   // TPOS tag, which is disc number / disc total and get the disc number from that.
   // If that doesn't exist, assume disc 1.
-  if v, present := song[DiscNumberKey]; present {
-    song[DiscNumberKey] = cleanUpNumber(v)
+  if _, present := song[DiscNumberKey]; present {
+    dndt = song.Get(DiscNumberKey)
+    song.Set(DiscNumberKey, cleanUpNumber(dndt))
   } else {
-    if dndt, dndtPresent := song["TPOS"]; dndtPresent {
-      song[DiscNumberKey] = cleanUpNumber(dndt)
+    if _, dndtPresent := song["TPOS"]; dndtPresent {
+      dndt = song.Get("TPOS")
+      song.Set(DiscNumberKey, cleanUpNumber(dndt))
     } else {
-      song[DiscNumberKey] = "1"
+      song.Set(DiscNumberKey, "1")
+    }
+  }
+  setTotal(song, DiscTotalKey, dndt, "DISCTOTAL", "TOTALDISCS")
+}
+
+// Returns the standard key for k, if there is one.  ID3 comments and lyrics
+// without a description translate whatever their language.
+func keyTranslation(k string) (string, bool) {
+  if trans, present := keyTranslations[k]; present {
+    return trans, true
+  }
+  id, rest, _ := strings.Cut(k, ":")
+  if language, description, found := strings.Cut(rest, ":"); found && language != "" && description == "" {
+    switch id {
+    case "COMM", "COM":
+      return CommentKey, true
+    case "USLT", "ULT":
+      return LyricsKey, true
+    }
+  }
+  return "", false
+}
+
+// Returns the keys of song that have translations, in keyPriority order.
+func translationOrder(song MultiTagMap) []string {
+  priority := func(k string) int {
+    for j, p := range keyPriority {
+      if p == k {
+        return j
+      }
+    }
+    return len(keyPriority)
+  }
+  keys := make([]string, 0, len(song))
+  for k := range song {
+    if _, present := keyTranslation(k); present {
+      keys = append(keys, k)
+    }
+  }
+  sort.Slice(keys, func(i, j int) bool {
+    if pi, pj := priority(keys[i]), priority(keys[j]); pi != pj {
+      return pi < pj
+    }
+    return keys[i] < keys[j]
+  })
+  return keys
+}
+
+// Vorbis comments have the total in a separate field, which has two common
+// names (checked in order).  Otherwise, it follows the slash in the number.
+func setTotal(song MultiTagMap, key string, number string, keys ...string) {
+  for _, k := range keys {
+    if _, present := song[k]; present {
+      if _, done := song[key]; !done && song.Get(k) != "" {
+        song.Set(key, stripLeadingZero(song.Get(k)))
+      }
+      delete(song, k)
+    }
+  }
+  if _, present := song[key]; present {
+    return
+  }
+  if n := strings.Index(number, "/"); n >= 0 {
+    if total := strings.TrimSpace(number[n+1:]); total != "" {
+      song.Set(key, stripLeadingZero(total))
     }
   }
 }
@@ -89,7 +347,7 @@ func cleanUpNumber(v string) string {
 }
 
 func stripLeadingZero(s string) string {
-  if len(s) == 1 {
+  if len(s) <= 1 {
     return s
   }
   if s[0] == '0' {
@@ -0,0 +1,140 @@
+package tags
+
+import (
+  "bytes"
+  "encoding/binary"
+  "log"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// Builds a flac file with a stream info block and a Vorbis comment block
+// holding the given comments.
+func testFlac(comments ...string) []byte {
+  var b bytes.Buffer
+  b.WriteString("fLaC")
+  b.Write([]byte{streaminfotype, 0, 0, 34})
+  streaminfo := make([]byte, 34)
+  binary.BigEndian.PutUint32(streaminfo[10:], 44100 << 12 | 1 << 9 | 15 << 4)
+  binary.BigEndian.PutUint32(streaminfo[14:], 441000)
+  b.Write(streaminfo)
+  var c bytes.Buffer
+  binary.Write(&c, binary.LittleEndian, uint32(0))
+  binary.Write(&c, binary.LittleEndian, uint32(len(comments)))
+  for _, comment := range comments {
+    binary.Write(&c, binary.LittleEndian, uint32(len(comment)))
+    c.WriteString(comment)
+  }
+  size := c.Len()
+  b.Write([]byte{commenttype | 0x80, byte(size >> 16), byte(size >> 8), byte(size)})
+  b.Write(c.Bytes())
+  return b.Bytes()
+}
+
+func TestStandardTagsWithEmptyNumbers(t *testing.T) {
+  for _, comments := range [][]string{
+    { "TRACKNUMBER=", "DISCNUMBER=" },
+    { "TRACKNUMBER=/12", "DISCNUMBER=/2" },
+  } {
+    f := testFlac(comments...)
+    m, err := ReadStandardTagsFrom(bytes.NewReader(f), int64(len(f)))
+    if err != nil {
+      t.Fatalf("%v: %v", comments, err)
+    }
+    if m[TrackNumberKey] != "" || m[DiscNumberKey] != "" {
+      t.Errorf("%v: track %q, disc %q", comments, m[TrackNumberKey], m[DiscNumberKey])
+    }
+  }
+  f := testFlac("TRACKNUMBER=/12")
+  m, err := ReadStandardMultiTagsFrom(bytes.NewReader(f), int64(len(f)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if m.Get(TrackTotalKey) != "12" {
+    t.Errorf("track total %q", m.Get(TrackTotalKey))
+  }
+}
+
+func TestReadStandardTagsDoesNotLog(t *testing.T) {
+  var buf bytes.Buffer
+  log.SetOutput(&buf)
+  defer log.SetOutput(os.Stderr)
+  f := testFlac("TITLE=Song")
+  if _, err := ReadStandardTagsFrom(bytes.NewReader(f), int64(len(f))); err != nil {
+    t.Fatal(err)
+  }
+  if buf.Len() > 0 {
+    t.Errorf("logged %q", buf.String())
+  }
+}
+
+func TestStandardKeysAcrossFormats(t *testing.T) {
+  f := testFlac("GENRE=Jazz", "COMPOSER=Someone", "ALBUMARTIST=Band")
+  m, err := ReadStandardTagsFrom(bytes.NewReader(f), int64(len(f)))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if m[GenreKey] != "Jazz" || m[ComposerKey] != "Someone" || m[AlbumArtistKey] != "Band" {
+    t.Errorf("flac: %v", m)
+  }
+  for v, want := range map[string]string{ "(17)": "Rock", "17": "Rock", "(4)Eurodisco": "Eurodisco", "((Bracketed)": "(Bracketed)", "Shoegaze": "Shoegaze", "(RX)": "Remix" } {
+    song := MultiTagMap{ "TCON": { v } }
+    translateMultiKeys(song)
+    if song.Get(GenreKey) != want {
+      t.Errorf("TCON %q: %q, want %q", v, song.Get(GenreKey), want)
+    }
+  }
+}
+
+func TestDateKeyPriority(t *testing.T) {
+  // Map order varies from run to run, so try several times.
+  for j := 0; j < 20; j++ {
+    song := MultiTagMap{ "TYER": { "2003" }, "TDRC": { "2004-05-17" }, "TYE": { "2002" }, DateKey: { "1999" } }
+    translateMultiKeys(song)
+    if got := song.GetAll(DateKey); len(got) != 1 || got[0] != "2004-05-17" {
+      t.Fatalf("date %q", got)
+    }
+    for _, k := range []string{ "TYER", "TDRC", "TYE" } {
+      if _, present := song[k]; present {
+        t.Errorf("%s not removed", k)
+      }
+    }
+  }
+}
+
+func TestGenreKeyPriority(t *testing.T) {
+  for j := 0; j < 20; j++ {
+    song := MultiTagMap{ "gnre": { "Rock" }, "\xa9gen": { "Shoegaze" } }
+    translateMultiKeys(song)
+    if got := song.GetAll(GenreKey); len(got) != 1 || got[0] != "Shoegaze" {
+      t.Fatalf("m4a genre %q", got)
+    }
+    song = MultiTagMap{ "TCO": { "(17)" }, "TCON": { "(20)" } }
+    translateMultiKeys(song)
+    if got := song.GetAll(GenreKey); len(got) != 1 || got[0] != "Alternative" {
+      t.Fatalf("ID3 genre %q", got)
+    }
+  }
+}
+
+func TestGetStandardTagsFromFileMultipleGenres(t *testing.T) {
+  frame := []byte("TCON\x00\x00\x00\x06\x00\x00\x0017\x0020")
+  b := append([]byte{ 'I', 'D', '3', 4, 0, 0, 0, 0, 0, byte(len(frame)) }, frame...)
+  b = append(b, testMp3Frames(3)...)
+  path := filepath.Join(t.TempDir(), "song.mp3")
+  if err := os.WriteFile(path, b, 0644); err != nil {
+    t.Fatal(err)
+  }
+  var buf bytes.Buffer
+  log.SetOutput(&buf)
+  defer log.SetOutput(os.Stderr)
+  m := GetStandardTagsFromFile(path)
+  if want := "Rock" + MultiValueSeparator + "Alternative"; m[GenreKey] != want {
+    t.Errorf("genre %q, want %q", m[GenreKey], want)
+  }
+  if !strings.Contains(buf.String(), "Can't get track number") {
+    t.Errorf("logged %q", buf.String())
+  }
+}
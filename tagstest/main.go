@@ -36,7 +36,10 @@ func main() {
 }
 
 func dumpFile(path string) {
-  m := tags.GetStandardTagsFromFile(path)
+  m, err := tags.ReadStandardTags(path)
+  if err != nil {
+    fmt.Printf("error reading %s: %s\n", path, err.Error())
+  }
   fmt.Printf("file %s has %d tags\n", path, len(m))
   for key, value := range m {
     fmt.Printf("%s: %s\n", key, value)
@@ -0,0 +1,172 @@
+package tags
+
+import (
+  "strconv"
+  "strings"
+  "time"
+)
+
+// A Track holds the standard tags of a file, parsed into their natural
+// types.  Numbers that are missing or can't be parsed are zero.
+type Track struct {
+  Title string
+  Artists []string
+  Album string
+  AlbumArtist string
+  Composer string
+  Genre string
+  ArtistSort string
+  AlbumSort string
+  Track int
+  TrackTotal int
+  Disc int
+  DiscTotal int
+  Date string
+  Year int
+  Duration time.Duration
+  SampleRate int
+  Channels int
+  BitsPerSample int
+  Bitrate int // average, in kbit/s
+  Mime string
+  Extension string
+  RelativePath string
+  BasePath string
+  HasArtwork bool
+}
+
+// TrackFromTagMap converts a map of standard tags, such as that returned by
+// ReadStandardTags, to a Track.  The artists are split at MultiValueSeparator.
+func TrackFromTagMap(m TagMap) Track {
+  multi := make(MultiTagMap, len(m))
+  for k, v := range m {
+    multi.Set(k, v)
+  }
+  if artists, present := m[ArtistKey]; present {
+    multi[ArtistKey] = strings.Split(artists, MultiValueSeparator)
+  }
+  return TrackFromMultiTagMap(multi)
+}
+
+// TrackFromMultiTagMap is like TrackFromTagMap, but takes a map such as that
+// returned by ReadStandardMultiTags.
+func TrackFromMultiTagMap(m MultiTagMap) Track {
+  var t Track
+  t.Title = m.Get(TitleKey)
+  t.Artists = m.GetAll(ArtistKey)
+  t.Album = m.Get(AlbumKey)
+  t.AlbumArtist = m.Get(AlbumArtistKey)
+  t.Composer = m.Get(ComposerKey)
+  t.Genre = m.Get(GenreKey)
+  t.ArtistSort = m.Get(ArtistSortKey)
+  t.AlbumSort = m.Get(AlbumSortKey)
+  t.Track, t.TrackTotal = splitNumber(m.Get(TrackNumberKey))
+  t.Disc, t.DiscTotal = splitNumber(m.Get(DiscNumberKey))
+  if total, err := strconv.Atoi(m.Get(TrackTotalKey)); err == nil {
+    t.TrackTotal = total
+  }
+  if total, err := strconv.Atoi(m.Get(DiscTotalKey)); err == nil {
+    t.DiscTotal = total
+  }
+  t.Date = m.Get(DateKey)
+  if len(t.Date) >= 4 {
+    t.Year, _ = strconv.Atoi(t.Date[:4])
+  }
+  if millis, err := strconv.ParseInt(m.Get(DurationMillisKey), 10, 64); err == nil {
+    t.Duration = time.Duration(millis) * time.Millisecond
+  } else {
+    t.Duration = parseDuration(m.Get(DurationKey))
+  }
+  t.SampleRate, _ = strconv.Atoi(m.Get(SampleRateKey))
+  t.Channels, _ = strconv.Atoi(m.Get(ChannelsKey))
+  t.BitsPerSample, _ = strconv.Atoi(m.Get(BitsPerSampleKey))
+  t.Bitrate, _ = strconv.Atoi(m.Get(BitrateKey))
+  t.Mime = m.Get(MimeKey)
+  t.Extension = m.Get(ExtensionKey)
+  t.RelativePath = m.Get(RelativePathKey)
+  t.BasePath = m.Get(BasePathKey)
+  t.HasArtwork = m.Get(HasArtworkKey) == "true"
+  return t
+}
+
+// Standard returns the track as a map of standard tags.  Empty strings and
+// zero numbers are left out.
+func (t Track) Standard() TagMap {
+  m := make(TagMap)
+  setString := func(key, value string) {
+    if value != "" {
+      m[key] = value
+    }
+  }
+  setInt := func(key string, value int) {
+    if value != 0 {
+      m[key] = strconv.Itoa(value)
+    }
+  }
+  setString(TitleKey, t.Title)
+  setString(ArtistKey, strings.Join(t.Artists, MultiValueSeparator))
+  setString(AlbumKey, t.Album)
+  setString(AlbumArtistKey, t.AlbumArtist)
+  setString(ComposerKey, t.Composer)
+  setString(GenreKey, t.Genre)
+  setString(ArtistSortKey, t.ArtistSort)
+  setString(AlbumSortKey, t.AlbumSort)
+  setInt(TrackNumberKey, t.Track)
+  setInt(TrackTotalKey, t.TrackTotal)
+  setInt(DiscNumberKey, t.Disc)
+  setInt(DiscTotalKey, t.DiscTotal)
+  if t.Date == "" {
+    setInt(DateKey, t.Year)
+  }
+  setString(DateKey, t.Date)
+  if t.Duration > 0 {
+    m[DurationKey] = formatDuration(int(t.Duration.Round(time.Second) / time.Second))
+    m[DurationMillisKey] = strconv.FormatInt(t.Duration.Milliseconds(), 10)
+  }
+  setInt(SampleRateKey, t.SampleRate)
+  setInt(ChannelsKey, t.Channels)
+  setInt(BitsPerSampleKey, t.BitsPerSample)
+  setInt(BitrateKey, t.Bitrate)
+  setString(MimeKey, t.Mime)
+  setString(ExtensionKey, t.Extension)
+  setString(RelativePathKey, t.RelativePath)
+  setString(BasePathKey, t.BasePath)
+  if t.HasArtwork {
+    m[HasArtworkKey] = "true"
+  }
+  return m
+}
+
+// Splits a number such as "3/12" into the number and the total.
+func splitNumber(s string) (int, int) {
+  number, total, _ := strings.Cut(s, "/")
+  n, _ := strconv.Atoi(strings.TrimSpace(number))
+  t, _ := strconv.Atoi(strings.TrimSpace(total))
+  return n, t
+}
+
+// Parses a duration in the [h:]mm:ss form used by DurationKey.
+func parseDuration(s string) time.Duration {
+  var d time.Duration
+  for _, part := range strings.Split(s, ":") {
+    n, err := strconv.Atoi(part)
+    if err != nil {
+      return 0
+    }
+    d = d * 60 + time.Duration(n)
+  }
+  return d * time.Second
+}
+
+// TrackSlice sorts tracks the same way as TagMapSlice, without parsing the
+// disc and track numbers on every comparison.
+type TrackSlice []Track
+
+func (s TrackSlice) Len() int { return len(s) }
+func (s TrackSlice) Less(i, j int) bool {
+  if s[i].ArtistSort != s[j].ArtistSort { return s[i].ArtistSort < s[j].ArtistSort }
+  if s[i].AlbumSort != s[j].AlbumSort { return s[i].AlbumSort < s[j].AlbumSort }
+  if s[i].Disc != s[j].Disc { return s[i].Disc < s[j].Disc }
+  return s[i].Track < s[j].Track
+}
+func (s TrackSlice) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
@@ -1,26 +1,28 @@
 package tags
 
 import (
-  "os"
   "math"
   "fmt"
+  "strconv"
 )
 
-func check(e error) {
-  if e!= nil {
-    panic(e)
-  }
+func setDuration(duration float64, m MultiTagMap) {
+  m.Set(DurationKey, formatDuration(int(math.Round(duration))))
+  m.Set(DurationMillisKey, strconv.FormatInt(int64(math.Round(duration * 1000)), 10))
 }
 
-func readFile(path string) []byte {
-  b, err := os.ReadFile(path)
-  check(err)
-  return b
+// Sets the average bitrate from the size of the audio, in bytes, and the
+// duration, which must already have been set.
+func setBitrate(size int64, m MultiTagMap) {
+  millis, err := strconv.ParseInt(m.Get(DurationMillisKey), 10, 64)
+  if err != nil || millis <= 0 {
+    return
+  }
+  m.Set(BitrateKey, strconv.FormatInt((size * 8 + millis / 2) / millis, 10))
 }
 
-func setDuration(duration float64, m TagMap) {
-  // Round to nearest integer, make it a string, convert to [hh:]mm:ss.
-  totalSeconds := int(math.Round(duration))
+// Converts a number of seconds to [h:]mm:ss.
+func formatDuration(totalSeconds int) string {
   hours := 0
   minutes := totalSeconds / 60
   seconds := totalSeconds % 60
@@ -29,13 +31,19 @@ func setDuration(duration float64, m TagMap) {
     minutes = minutes - 60
   }
   if hours > 0 {
-    m[DurationKey] = fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
-  } else {
-    m[DurationKey] = fmt.Sprintf("%d:%02d", minutes, seconds)
+    return fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
   }
+  return fmt.Sprintf("%d:%02d", minutes, seconds)
 }
 
-func setMimeAndExtension(mime string, extension string, m TagMap) {
-  m[MimeKey] = mime
-  m[ExtensionKey] = extension
+func setMimeAndExtension(mime string, extension string, m MultiTagMap) {
+  m.Set(MimeKey, mime)
+  m.Set(ExtensionKey, extension)
+}
+
+func minInt(a, b int) int {
+  if a < b {
+    return a
+  }
+  return b
 }